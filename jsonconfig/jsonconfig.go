@@ -20,7 +20,9 @@ package jsonconfig
 
 import (
 	"fmt"
+	"math"
 	"strings"
+	"time"
 )
 
 // Obj is a JSON configuration map.
@@ -168,6 +170,41 @@ func (jc Obj) int(key string, def *int) int {
 	return int(b)
 }
 
+func (jc Obj) RequiredDuration(key string) time.Duration {
+	return jc.duration(key, nil)
+}
+
+func (jc Obj) OptionalDuration(key string, def time.Duration) time.Duration {
+	return jc.duration(key, &def)
+}
+
+// duration accepts either a string in time.ParseDuration format
+// (e.g. "1.5s", "5m") or a number of seconds.
+func (jc Obj) duration(key string, def *time.Duration) time.Duration {
+	jc.noteKnownKey(key)
+	ei, ok := jc[key]
+	if !ok {
+		if def != nil {
+			return *def
+		}
+		jc.appendError(fmt.Errorf("Missing required config key %q (duration)", key))
+		return 0
+	}
+	switch v := ei.(type) {
+	case float64:
+		return time.Duration(v * float64(time.Second))
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			jc.appendError(fmt.Errorf("Expected config key %q to be a duration: %v", key, err))
+			return 0
+		}
+		return d
+	}
+	jc.appendError(fmt.Errorf("Expected config key %q to be a duration string or number of seconds", key))
+	return 0
+}
+
 func (jc Obj) RequiredList(key string) []string {
 	return jc.requiredList(key, true)
 }
@@ -202,6 +239,35 @@ func (jc Obj) requiredList(key string, required bool) []string {
 	return sl
 }
 
+// OptionalIntList returns the list of integers at key, or nil if it
+// isn't set.
+func (jc Obj) OptionalIntList(key string) []int {
+	jc.noteKnownKey(key)
+	ei, ok := jc[key]
+	if !ok {
+		return nil
+	}
+	eil, ok := ei.([]interface{})
+	if !ok {
+		jc.appendError(fmt.Errorf("Expected config key %q to be a list, not %T", key, ei))
+		return nil
+	}
+	il := make([]int, len(eil))
+	for i, ei := range eil {
+		n, ok := ei.(float64)
+		if !ok {
+			jc.appendError(fmt.Errorf("Expected config key %q index %d to be a number, not %T", key, i, ei))
+			return nil
+		}
+		if n != math.Trunc(n) || n < math.MinInt32 || n > math.MaxInt32 {
+			jc.appendError(fmt.Errorf("Expected config key %q index %d to be an integer, not %v", key, i, n))
+			return nil
+		}
+		il[i] = int(n)
+	}
+	return il
+}
+
 func (jc Obj) noteKnownKey(key string) {
 	_, ok := jc["_knownkeys"]
 	if !ok {
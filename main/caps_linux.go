@@ -0,0 +1,106 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	prSetKeepCaps     = 8
+	prCapBSetDrop     = 24
+	prSetNoNewPrivs   = 38
+	prCapAmbient      = 47
+	prCapAmbientRaise = 2
+
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+// Capabilities, like the rest of the child's credentials, are per
+// thread, so these must run on the thread that execs; see
+// MaybeBecomeChildProcess.
+
+// limitCaps, run before dropping root, limits the capability bounding
+// set to caps, and keeps the permitted set across Setuid so raiseCaps
+// can pick from it.
+func limitCaps(caps []int) error {
+	keep := capMask(caps)
+	for c := uint(0); c < 64; c++ {
+		if keep&(1<<c) != 0 {
+			continue
+		}
+		if err := prctl(prCapBSetDrop, uintptr(c), 0, 0); err == syscall.EINVAL {
+			break // past the kernel's last capability
+		} else if err != nil {
+			return fmt.Errorf("dropping capability %d from bounding set: %v", c, err)
+		}
+	}
+	if err := prctl(prSetKeepCaps, 1, 0, 0); err != nil {
+		return fmt.Errorf("PR_SET_KEEPCAPS: %v", err)
+	}
+	return nil
+}
+
+// raiseCaps, run after dropping root, sets the permitted, effective,
+// inheritable and ambient capabilities to exactly caps. Ambient
+// capabilities survive exec of an unprivileged binary.
+func raiseCaps(caps []int) error {
+	mask := capMask(caps)
+	hdr := struct {
+		version uint32
+		pid     int32
+	}{linuxCapabilityVersion3, 0}
+	var data [2]struct {
+		effective, permitted, inheritable uint32
+	}
+	for i := range data {
+		m := uint32(mask >> (32 * uint(i)))
+		data[i].effective, data[i].permitted, data[i].inheritable = m, m, m
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		return fmt.Errorf("capset: %v", errno)
+	}
+	for _, c := range caps {
+		if err := prctl(prCapAmbient, prCapAmbientRaise, uintptr(c), 0); err != nil {
+			return fmt.Errorf("raising ambient capability %d: %v", c, err)
+		}
+	}
+	return nil
+}
+
+func setNoNewPrivs() error {
+	return prctl(prSetNoNewPrivs, 1, 0, 0)
+}
+
+func capMask(caps []int) uint64 {
+	var mask uint64
+	for _, c := range caps {
+		mask |= 1 << uint(c)
+	}
+	return mask
+}
+
+func prctl(option, arg2, arg3, arg4 uintptr) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, option, arg2, arg3, arg4, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
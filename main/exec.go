@@ -19,8 +19,11 @@ package main
 import (
 	"encoding/base64"
 	"encoding/gob"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"syscall"
 
@@ -34,22 +37,52 @@ func MaybeBecomeChildProcess() {
 	}
 	defer os.Exit(2) // should never make it this far, though
 
+	// Stay on one thread: some of what follows, like capabilities,
+	// only applies to the calling thread, which must be the one
+	// that execs.
+	runtime.LockOSThread()
+
 	lr := new(LaunchRequest)
 	d := gob.NewDecoder(base64.NewDecoder(base64.StdEncoding, strings.NewReader(lrs)))
 	err := d.Decode(lr)
 	if err != nil {
 		log.Fatalf("Failed to decode LaunchRequest in child: %v", err)
 	}
-	if lr.NumFiles != 0 {
-		var lim syscall.Rlimit
-		if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
-			log.Fatalf("failed to get NOFILE rlimit: %v", err)
+	if lr.Cgroup != "" {
+		procs := filepath.Join(lr.Cgroup, "cgroup.procs")
+		// "0" is this process; in a PID namespace, Getpid is 1.
+		if err := ioutil.WriteFile(procs, []byte("0"), 0); err != nil {
+			log.Fatalf("failed to join cgroup: %v", err)
 		}
-		noFile := rlim_t(lr.NumFiles)
-		lim.Cur = noFile
-		lim.Max = noFile
-		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
-			log.Fatalf("failed to set NOFILE rlimit: %v", err)
+	}
+	for _, rl := range lr.Rlimits {
+		lim := syscall.Rlimit{Cur: rlim_t(rl.Cur), Max: rlim_t(rl.Max)}
+		if err := syscall.Setrlimit(rl.Resource, &lim); err != nil {
+			log.Fatalf("failed to set %s rlimit: %v", rl.Name, err)
+		}
+	}
+	if lr.Sched != nil {
+		if err := applySched(lr.Sched); err != nil {
+			log.Fatalf("failed to apply scheduling attributes: %v", err)
+		}
+	}
+	if lr.Sandbox != nil {
+		if err := setupSandbox(lr.Sandbox, lr.Root); err != nil {
+			log.Fatalf("failed to set up sandbox: %v", err)
+		}
+	} else if lr.Root != "" {
+		if err := syscall.Chroot(lr.Root); err != nil {
+			log.Fatalf("failed to chroot to %q: %v", lr.Root, err)
+		}
+		// Chroot leaves the cwd outside the root; a relative
+		// Dir is within it.
+		if err := os.Chdir(filepath.Join("/", lr.Dir)); err != nil {
+			log.Fatalf("failed to chdir to %q in root: %v", lr.Dir, err)
+		}
+	}
+	if lr.LimitCapabilities {
+		if err := limitCaps(lr.Capabilities); err != nil {
+			log.Fatalf("failed to limit capabilities: %v", err)
 		}
 	}
 	if lr.Gid != 0 {
@@ -67,12 +100,33 @@ func MaybeBecomeChildProcess() {
 			log.Fatalf("failed to Setuid(%d): %v", lr.Uid, err)
 		}
 	}
-	if lr.Path != "" {
-		err = os.Chdir(lr.Dir)
+	if lr.LimitCapabilities {
+		if err := raiseCaps(lr.Capabilities); err != nil {
+			log.Fatalf("failed to set capabilities: %v", err)
+		}
+	}
+	if lr.NoNewPrivileges {
+		if err := setNoNewPrivs(); err != nil {
+			log.Fatalf("failed to set no_new_privs: %v", err)
+		}
+	}
+	dir := lr.Dir
+	if lr.Root != "" {
+		if lr.Sandbox == nil {
+			dir = "" // the chroot above already changed to it
+		} else {
+			dir = filepath.Join("/", dir) // within the root, as tasks.Task checked
+		}
+	}
+	if dir != "" {
+		err = os.Chdir(dir)
 		if err != nil {
-			log.Fatalf("failed to chdir to %q: %v", lr.Dir, err)
+			log.Fatalf("failed to chdir to %q: %v", dir, err)
 		}
 	}
+	if lr.Sandbox != nil && lr.Sandbox.PID {
+		os.Exit(runAsInit(lr))
+	}
 	err = syscall.Exec(lr.Path, lr.Argv, lr.Env)
 	log.Fatalf("failed to exec %q: %v", lr.Path, err)
 }
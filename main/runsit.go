@@ -20,11 +20,14 @@ limitations under the License.
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sort"
 	"syscall"
 
@@ -34,8 +37,12 @@ import (
 
 // Flags.
 var (
-	httpPort  = flag.Int("http_port", 4762, "HTTP localhost admin port.")
-	configDir = flag.String("config_dir", "/etc/runsit", "Directory containing per-task *.json config files.")
+	httpPort   = flag.Int("http_port", 4762, "HTTP localhost admin port.")
+	configDir  = flag.String("config_dir", "/etc/runsit", "Directory containing per-task *.json config files.")
+	cgroupRoot = flag.String("cgroup_root", "", "cgroup v2 directory to create task cgroups in, for tasks with resource limits. Defaults to runsit's own cgroup.")
+	logDir     = flag.String("log_dir", "", "Directory to log tasks' output to, in a directory per task. Tasks may also configure their own with a \"log\" block.")
+	initMode   = flag.Bool("init", false, "Run as a container's init process (PID 1): reap all orphaned processes, and stop all tasks on SIGHUP too.")
+	mainTask   = flag.String("main_task", "", "With -init, the task whose exit, once it isn't restarted, stops all tasks and exits runsit with its exit status.")
 )
 
 
@@ -68,26 +75,76 @@ func handleSignals() {
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc)
 
-	for s := range sigc {
-		switch s {
-		case os.Interrupt, os.Signal(syscall.SIGTERM):
-			Logger.Printf("Got signal %q; stopping all tasks.", s)
-			for _, t := range GetTasks() {
-				t.Stop()
+	for {
+		select {
+		case status := <-MainExit:
+			Logger.Printf("Main task %q exited with status %d; stopping all tasks.", *mainTask, status)
+			stopAllTasks()
+			Logger.Printf("Tasks all stopped; quitting with status %d.", status)
+			os.Exit(status)
+		case s := <-sigc:
+			switch s {
+			case os.Interrupt, os.Signal(syscall.SIGTERM), os.Signal(syscall.SIGHUP):
+				if s == os.Signal(syscall.SIGHUP) && !*initMode {
+					Logger.Printf("unhandled signal: %T %#v", s, s)
+					continue
+				}
+				Logger.Printf("Got signal %q; stopping all tasks.", s)
+				stopAllTasks()
+				Logger.Printf("Tasks all stopped after %s; quitting.", s)
+				os.Exit(0)
+			case os.Signal(syscall.SIGCHLD):
+				ReapOrphans()
+			default:
+				Logger.Printf("unhandled signal: %T %#v", s, s)
 			}
-			Logger.Printf("Tasks all stopped after %s; quitting.", s)
-			os.Exit(0)
-		case os.Signal(syscall.SIGCHLD):
-			// Ignore.
-		default:
-			Logger.Printf("unhandled signal: %T %#v", s, s)
 		}
 	}
 }
 
+// stopAllTasks stops each task with its configured stop signal and
+// timeout, stopping dependents before the tasks they depend on.
+func stopAllTasks() {
+	for _, t := range StopOrder(GetTasks()) {
+		t.Stop()
+	}
+}
+
+// checkInitFlags validates the -init and -main_task flags. As a
+// container's init process, runsit has no one to fix a bad config
+// for it later, so the config directory (typically baked into the
+// image) must be readable and include the main task.
+func checkInitFlags() error {
+	if *mainTask != "" && !*initMode {
+		return errors.New("-main_task requires -init")
+	}
+	if !*initMode {
+		return nil
+	}
+	if _, err := ioutil.ReadDir(*configDir); err != nil {
+		return err
+	}
+	if *mainTask != "" {
+		if _, err := os.Stat(filepath.Join(*configDir, *mainTask+".json")); err != nil {
+			return fmt.Errorf("main task: %v", err)
+		}
+	}
+	return nil
+}
+
 func main() {
 	MaybeBecomeChildProcess()
 	flag.Parse()
+	CgroupRoot = *cgroupRoot
+	LogDir = *logDir
+	if err := checkInitFlags(); err != nil {
+		Logger.Printf("Error: %v", err)
+		os.Exit(1)
+	}
+	MainTask = *mainTask
+	if err := BecomeSubreaper(); err != nil {
+		Logger.Printf("Not reaping orphaned task processes: %v", err)
+	}
 
 	listenAddr := "localhost"
 	if a := os.Getenv("RUNSIT_LISTEN"); a != "" {
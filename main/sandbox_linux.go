@@ -0,0 +1,212 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+
+	. "github.com/bradfitz/runsit/tasks"
+)
+
+// setupSandbox sets up the child's mounts and network, in the
+// namespaces LaunchRequest.start created for it. If root is set, it
+// becomes the root directory, and the rest of the sandbox's paths
+// are within it.
+func setupSandbox(sb *Sandbox, root string) error {
+	// Keep our mounts from propagating back out of the namespace.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %v", err)
+	}
+	if root != "" {
+		if err := pivotRoot(root); err != nil {
+			return err
+		}
+	}
+	if sb.ReadOnlyRoot {
+		if err := bindReadOnly("/"); err != nil {
+			return err
+		}
+	}
+	if sb.PrivateTmp {
+		if err := syscall.Mount("tmpfs", "/tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("mounting /tmp: %v", err)
+		}
+	}
+	if sb.PID {
+		// So /proc shows the namespace's processes.
+		if err := syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+			return fmt.Errorf("mounting /proc: %v", err)
+		}
+	}
+	for _, p := range sb.ReadOnlyPaths {
+		if err := bindReadOnly(p); err != nil {
+			return err
+		}
+	}
+	if sb.Network {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("bringing up loopback: %v", err)
+		}
+	}
+	if sb.Hostname != "" {
+		if err := syscall.Sethostname([]byte(sb.Hostname)); err != nil {
+			return fmt.Errorf("setting hostname: %v", err)
+		}
+	}
+	return nil
+}
+
+// pivotRoot makes root the root of the mount namespace. Unlike a
+// chroot, the old root is then gone entirely.
+func pivotRoot(root string) error {
+	// pivot_root needs the new root to be a mount point.
+	if err := syscall.Mount(root, root, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind-mounting %s: %v", root, err)
+	}
+	if err := syscall.Chdir(root); err != nil {
+		return err
+	}
+	// Pivoting onto "." stacks the old root on top of the new
+	// one, from where it can be detached.
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root to %s: %v", root, err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("detaching old root: %v", err)
+	}
+	return syscall.Chdir("/")
+}
+
+// bindReadOnly bind-mounts path on itself, read-only.
+func bindReadOnly(path string) error {
+	if err := syscall.Mount(path, path, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind-mounting %s: %v", path, err)
+	}
+	// A remount has to keep the flags of the mount it's bound
+	// from, or it fails in a user namespace.
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return fmt.Errorf("statfs %s: %v", path, err)
+	}
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	for _, f := range []struct{ st, ms uintptr }{
+		{0x2, syscall.MS_NOSUID},
+		{0x4, syscall.MS_NODEV},
+		{0x8, syscall.MS_NOEXEC},
+		{0x400, syscall.MS_NOATIME},
+		{0x800, syscall.MS_NODIRATIME},
+		{0x1000, syscall.MS_RELATIME},
+	} {
+		if uintptr(st.Flags)&f.st != 0 {
+			flags |= f.ms
+		}
+	}
+	if err := syscall.Mount("", path, "", flags, ""); err != nil {
+		return fmt.Errorf("remounting %s read-only: %v", path, err)
+	}
+	return nil
+}
+
+// loopbackUp brings up the loopback interface in a new network
+// namespace, which starts out down.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], "lo")
+	if err := ioctl(fd, syscall.SIOCGIFFLAGS, unsafe.Pointer(&ifr)); err != nil {
+		return err
+	}
+	ifr.flags |= syscall.IFF_UP
+	return ioctl(fd, syscall.SIOCSIFFLAGS, unsafe.Pointer(&ifr))
+}
+
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// runAsInit runs lr's process as a child, in a process group of its
+// own, and acts as init for the sandbox's PID namespace until it
+// exits: it forwards signals to the process's group and reaps
+// orphans. (The process can't be PID 1 itself: PID 1 ignores signals
+// it has no handler for, such as the default stopSignal.)
+// It returns the exit status to exit with, 128+n if the process was
+// killed by signal n.
+func runAsInit(lr *LaunchRequest) int {
+	sigc := make(chan os.Signal, 16)
+	signal.Notify(sigc)
+
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	for i := 0; i < lr.NumExtraFiles; i++ {
+		files = append(files, os.NewFile(uintptr(3+i), fmt.Sprintf("fd #%d from runsit", 3+i)))
+	}
+	p, err := os.StartProcess(lr.Path, lr.Argv, &os.ProcAttr{
+		Env:   lr.Env,
+		Files: files,
+		Sys:   &syscall.SysProcAttr{Setpgid: true},
+	})
+	if err != nil {
+		log.Printf("failed to start %q: %v", lr.Path, err)
+		return 127
+	}
+	for _, f := range files[3:] {
+		f.Close()
+	}
+
+	for sig := range sigc {
+		switch sig {
+		case syscall.SIGCHLD:
+		case syscall.SIGURG:
+			// Used by the Go runtime; not for the child.
+			continue
+		default:
+			syscall.Kill(-p.Pid, sig.(syscall.Signal))
+			continue
+		}
+		for {
+			var ws syscall.WaitStatus
+			pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+			if err != nil || pid <= 0 {
+				break
+			}
+			if pid != p.Pid {
+				continue // reaped an orphan
+			}
+			if ws.Signaled() {
+				return 128 + int(ws.Signal())
+			}
+			return ws.ExitStatus()
+		}
+	}
+	panic("unreachable")
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	. "github.com/bradfitz/runsit/tasks"
+)
+
+const ioprioWhoProcess = 1
+
+// applySched applies s to the child before it drops root. Like
+// capabilities, priorities and affinity are per thread here, and the
+// child stays on the thread that execs.
+func applySched(s *Sched) error {
+	if s.SetNice {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, s.Nice); err != nil {
+			return fmt.Errorf("setting nice: %v", err)
+		}
+	}
+	if s.IOClass != IOClassNone {
+		prio := s.IOClass<<13 | s.IOPriority
+		_, _, errno := syscall.RawSyscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(prio))
+		if errno != 0 {
+			return fmt.Errorf("setting I/O priority: %v", errno)
+		}
+	}
+	if len(s.CPUs) > 0 {
+		var mask [MaxCPUs / 64]uint64
+		for _, c := range s.CPUs {
+			mask[c/64] |= 1 << uint(c%64)
+		}
+		_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask[0])))
+		if errno != 0 {
+			return fmt.Errorf("setting CPU affinity: %v", errno)
+		}
+	}
+	if s.SetOOMScoreAdj {
+		if err := ioutil.WriteFile("/proc/self/oom_score_adj", []byte(strconv.Itoa(s.OOMScoreAdj)), 0); err != nil {
+			return fmt.Errorf("setting oom_score_adj: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+// +build !linux
+
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	. "github.com/bradfitz/runsit/tasks"
+)
+
+// applySched applies s to the child before it drops root. Only nice
+// is supported here; see parseSched.
+func applySched(s *Sched) error {
+	if s.SetNice {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, s.Nice); err != nil {
+			return fmt.Errorf("setting nice: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	. "github.com/bradfitz/runsit/tasks"
+)
+
+const (
+	defaultSearchContext = 3
+	maxSearchContext     = 50
+	maxSearchMatches     = 1000
+)
+
+// parseSearchQuery parses a search of a task's output from r's
+// parameters:
+//
+//	q         regexp lines must match
+//	stream    as for streamFilter
+//	since     start of the time range; see parseSearchTime
+//	until     end of the time range
+//	instance  instance ID or PID
+//	where     filter on structured lines' fields, such as level>=warn; repeatable
+//	context   lines of context around each match
+//	limit     maximum number of matching lines
+func parseSearchQuery(r *http.Request) (*SearchQuery, error) {
+	q := &SearchQuery{
+		Streams:  streamFilter(r),
+		Instance: r.FormValue("instance"),
+		Context:  defaultSearchContext,
+		Limit:    maxSearchMatches,
+	}
+	var err error
+	if q.Filters, err = fieldFilters(r); err != nil {
+		return nil, err
+	}
+	if v := r.FormValue("q"); v != "" {
+		if q.Regexp, err = regexp.Compile(v); err != nil {
+			return nil, fmt.Errorf("bad q: %v", err)
+		}
+	}
+	if q.Since, err = parseSearchTime(r.FormValue("since")); err != nil {
+		return nil, fmt.Errorf("bad since: %v", err)
+	}
+	if q.Until, err = parseSearchTime(r.FormValue("until")); err != nil {
+		return nil, fmt.Errorf("bad until: %v", err)
+	}
+	if v := r.FormValue("context"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxSearchContext {
+			return nil, fmt.Errorf("bad context %q; want 0 to %d", v, maxSearchContext)
+		}
+		q.Context = n
+	}
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSearchMatches {
+			return nil, fmt.Errorf("bad limit %q; want 1 to %d", v, maxSearchMatches)
+		}
+		q.Limit = n
+	}
+	return q, nil
+}
+
+// parseSearchTime parses a time as RFC 3339, as "2006-01-02 15:04:05"
+// in local time, or as a duration before now, such as "10m". Empty
+// is the zero time.
+func parseSearchTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02 15:04:05", v, time.Local)
+}
+
+// searchTask handles the task page's search form.
+func searchTask(w http.ResponseWriter, r *http.Request, t *Task) {
+	q, err := parseSearchQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	drawTemplate(w, "searchTask", tmplData{
+		"Title":   t.Name + " search",
+		"Task":    t,
+		"Form":    r.Form,
+		"Results": t.Search(q),
+	})
+}
+
+type jsonSearchResult struct {
+	Instance string                     `json:"instance"`
+	Pid      int                        `json:"pid"`
+	Replica  int                        `json:"replica"`
+	Kind     string                     `json:"kind"`
+	Hunks    [][]map[string]interface{} `json:"hunks"`
+}
+
+// searchJSON handles /task/<name>/search, the query endpoint for
+// searches, which takes the parameters of parseSearchQuery.
+func searchJSON(w http.ResponseWriter, r *http.Request, t *Task) {
+	q, err := parseSearchQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	res := t.Search(q)
+	results := []jsonSearchResult{}
+	for _, sr := range res.Results {
+		jr := jsonSearchResult{
+			Instance: sr.Instance.ID(),
+			Pid:      sr.Instance.Pid(),
+			Replica:  sr.Replica,
+			Kind:     sr.Kind,
+		}
+		for _, h := range sr.Hunks {
+			var jh []map[string]interface{}
+			for _, l := range h {
+				jl := map[string]interface{}{
+					"t":      l.T.Format(time.RFC3339Nano),
+					"stream": l.Name,
+					"data":   l.Data,
+				}
+				if l.Match {
+					jl["match"] = true
+				}
+				lineExtrasJSON(jl, l.Line)
+				jh = append(jh, jl)
+			}
+			jr.Hunks = append(jr.Hunks, jh)
+		}
+		results = append(results, jr)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results":   results,
+		"matches":   res.Matches,
+		"truncated": res.Truncated,
+	})
+}
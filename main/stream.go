@@ -0,0 +1,229 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/bradfitz/runsit/tasks"
+)
+
+// streamPingInterval is how often an idle event stream gets a
+// comment, to keep proxies from timing it out.
+const streamPingInterval = 15 * time.Second
+
+// streamFilter returns the set of stream names ("stdout", "stderr"
+// or "system") requested with r's "stream" parameters, which may
+// also be comma-separated, or nil for all of them.
+func streamFilter(r *http.Request) map[string]bool {
+	r.ParseForm()
+	var want map[string]bool
+	for _, v := range r.Form["stream"] {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if want == nil {
+				want = make(map[string]bool)
+			}
+			want[name] = true
+		}
+	}
+	return want
+}
+
+// fieldFilters parses r's "where" parameters, such as "level>=warn",
+// into filters on structured output lines' fields.
+func fieldFilters(r *http.Request) ([]*FieldFilter, error) {
+	r.ParseForm()
+	var filters []*FieldFilter
+	for _, v := range r.Form["where"] {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		f, err := ParseFieldFilter(v)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// lineExtrasJSON adds to m, the JSON form of l, how many bytes were
+// truncated from it and, if it's a structured line, its parsed
+// fields.
+func lineExtrasJSON(m map[string]interface{}, l *Line) {
+	if l.Truncated > 0 {
+		m["truncated"] = l.Truncated
+	}
+	rec := l.Record
+	if rec == nil {
+		return
+	}
+	fields := [][2]string{}
+	for _, f := range rec.Fields {
+		fields = append(fields, [2]string{f.Key, f.Value})
+	}
+	m["level"] = rec.Level.String()
+	m["msg"] = rec.Message
+	m["fields"] = fields
+}
+
+// lineSink writes a line, or a note that lines were dropped, to a
+// streaming response.
+type lineSink interface {
+	line(l *Line) error
+	dropped(n int) error
+	ping() error
+}
+
+// streamOutput replays t's buffered output lines after after and
+// then streams its new ones to sink, until the client goes away.
+func streamOutput(w http.ResponseWriter, r *http.Request, t *Task, after int64, sink lineSink) {
+	want := streamFilter(r)
+	filters, err := fieldFilters(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	lines, watcher := t.WatchOutput(after)
+	defer watcher.Close()
+	send := func(l *Line) error {
+		if want != nil && !want[l.Name] || !MatchFilters(l, filters) {
+			return nil
+		}
+		return sink.line(l)
+	}
+	for _, l := range lines {
+		if send(l) != nil {
+			return
+		}
+	}
+	flush()
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			err = sink.ping()
+		case l := <-watcher.C:
+			if n := watcher.Dropped(); n > 0 {
+				err = sink.dropped(n)
+			}
+			if err == nil {
+				err = send(l)
+			}
+		}
+		if err != nil {
+			return
+		}
+		flush()
+	}
+}
+
+// eventSink writes lines as Server-Sent Events.
+type eventSink struct {
+	w http.ResponseWriter
+}
+
+func (s eventSink) line(l *Line) error {
+	m := map[string]interface{}{
+		"t":       l.T.Format(time.RFC3339Nano),
+		"stream":  l.Name,
+		"data":    l.Data,
+		"pid":     l.Pid(),
+		"replica": l.Replica(),
+	}
+	lineExtrasJSON(m, l)
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.w, "id: %d\nevent: line\ndata: %s\n\n", l.Seq, data)
+	return err
+}
+
+func (s eventSink) dropped(n int) error {
+	_, err := fmt.Fprintf(s.w, "event: dropped\ndata: %d\n\n", n)
+	return err
+}
+
+func (s eventSink) ping() error {
+	_, err := fmt.Fprintf(s.w, ": ping\n\n")
+	return err
+}
+
+// textSink writes lines as plain text, for curl.
+type textSink struct {
+	w http.ResponseWriter
+}
+
+func (s textSink) line(l *Line) error {
+	note := l.TruncationNote()
+	if note != "" {
+		note = " " + note
+	}
+	_, err := fmt.Fprintf(s.w, "%s %s %d: %s%s\n", l.T.Format("2006-01-02 15:04:05.000"), l.Name, l.Pid(), l.Data, note)
+	return err
+}
+
+func (s textSink) dropped(n int) error {
+	_, err := fmt.Fprintf(s.w, "[%d lines dropped]\n", n)
+	return err
+}
+
+func (s textSink) ping() error {
+	return nil
+}
+
+// streamEvents serves t's output as Server-Sent Events. Lines after
+// the "after" parameter or, when reconnecting, the Last-Event-ID
+// header are replayed first.
+func streamEvents(w http.ResponseWriter, r *http.Request, t *Task) {
+	after, _ := strconv.ParseInt(r.FormValue("after"), 10, 64)
+	if id, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); err == nil && id > after {
+		after = id
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	streamOutput(w, r, t, after, eventSink{w})
+}
+
+// streamText serves t's output as plain text, like tail -f.
+func streamText(w http.ResponseWriter, r *http.Request, t *Task) {
+	after, _ := strconv.ParseInt(r.FormValue("after"), 10, 64)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	streamOutput(w, r, t, after, textSink{w})
+}
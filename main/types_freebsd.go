@@ -14,11 +14,11 @@
 
 package main
 
-// rlim_t converts an int to the OS specific type for rlim_t.  UNIX defines
+// rlim_t converts a uint64 to the OS specific type for rlim_t.  UNIX defines
 // this to be uint64:
 //   http://pubs.opengroup.org/onlinepubs/007904975/basedefs/sys/resource.h.html
 // For legacy reasons FreeBSD defines this as int64:
 //   https://github.com/freebsd/freebsd/blob/d1a65cb7ef2fa0cefbf00f16367a7ba99edc0457/sys/sys/_types.h#L55
-func rlim_t(i int) int64 {
-	return int64(i)
+func rlim_t(v uint64) int64 {
+	return int64(v)
 }
@@ -16,6 +16,6 @@
 
 package main
 
-func rlim_t(i int) uint64 {
-	return uint64(i)
+func rlim_t(v uint64) uint64 {
+	return v
 }
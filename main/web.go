@@ -42,18 +42,11 @@ func taskList(w http.ResponseWriter, r *http.Request) {
 }
 
 func killTask(w http.ResponseWriter, r *http.Request, t *Task) {
-	st := t.Status()
-	in := st.Running
-	if in == nil {
-		http.Error(w, "task not running", 500)
-		return
-	}
 	pid, _ := strconv.Atoi(r.FormValue("pid"))
-	if in.Pid() != pid || pid == 0 {
-		http.Error(w, "active task pid doesn't match pid parameter", 500)
+	if err := t.Kill(pid); err != nil {
+		http.Error(w, err.Error(), 500)
 		return
 	}
-	t.Stop()
 	drawTemplate(w, "killTask", tmplData{
 		"Title": "Kill",
 		"Task":  t,
@@ -61,18 +54,78 @@ func killTask(w http.ResponseWriter, r *http.Request, t *Task) {
 	})
 }
 
+// stopStartTask handles the "stop" and "start" modes, which stop a
+// task until an operator starts it again, and vice versa.
+func stopStartTask(w http.ResponseWriter, r *http.Request, t *Task, mode string) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", 400)
+		return
+	}
+	if mode == "stop" {
+		t.Stop()
+	} else {
+		t.Start()
+	}
+	http.Redirect(w, r, "/task/"+t.Name, http.StatusFound)
+}
+
+// logHistoryLines is how many lines of a task's on-disk log history
+// are shown per page.
+const logHistoryLines = 500
+
+func logHistory(w http.ResponseWriter, r *http.Request, t *Task) {
+	page, err := t.LogHistory(r.FormValue("before"), logHistoryLines)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	drawTemplate(w, "logHistory", tmplData{
+		"Title": t.Name + " log history",
+		"Task":  t,
+		"Page":  page,
+	})
+}
+
 func taskView(w http.ResponseWriter, r *http.Request) {
 	taskName := r.URL.Path[len("/task/"):]
+	sub := ""
+	if i := strings.Index(taskName, "/"); i >= 0 {
+		taskName, sub = taskName[:i], taskName[i+1:]
+	}
 	t, ok := GetTask(taskName)
 	if !ok {
 		http.NotFound(w, r)
 		return
 	}
+	switch sub {
+	case "events":
+		streamEvents(w, r, t)
+		return
+	case "tail":
+		streamText(w, r, t)
+		return
+	case "search":
+		searchJSON(w, r, t)
+		return
+	case "":
+	default:
+		http.NotFound(w, r)
+		return
+	}
 	mode := r.FormValue("mode")
 	switch mode {
 	case "kill":
 		killTask(w, r, t)
 		return
+	case "stop", "start":
+		stopStartTask(w, r, t, mode)
+		return
+	case "history":
+		logHistory(w, r, t)
+		return
+	case "search":
+		searchTask(w, r, t)
+		return
 	default:
 		http.Error(w, "unknown mode", 400)
 		return
@@ -82,31 +135,60 @@ func taskView(w http.ResponseWriter, r *http.Request) {
 	data := tmplData{
 		"Title": t.Name + " status",
 		"Task":  t,
+		"Form":  r.Form,
 	}
 
 	st := t.Status()
-	in := st.Running
-	if in != nil {
-		data["PID"] = in.Pid()
-		data["Output"] = in.Output()
-		data["Cmd"] = in.Lr
-		data["StartTime"] = in.StartTime
-		data["StartAgo"] = time.Now().Sub(in.StartTime)
-	}
+	data["Status"] = st
+	data["MultiReplica"] = len(st.Replicas) > 1
+	var replicas []tmplData
+	var lastSeq int64 // of the lines shown, to stream those after
+	for _, rs := range st.Replicas {
+		rd := tmplData{
+			"Task":   t,
+			"Status": rs,
+		}
+		in := rs.Running
+		if in != nil {
+			data["Running"] = true
+			data["Cmd"] = in.Lr
+			rd["PID"] = in.Pid()
+			rd["Output"] = in.Output()
+			lastSeq = maxSeq(lastSeq, in.Output())
+			rd["StartTime"] = in.StartTime
+			rd["StartAgo"] = time.Now().Sub(in.StartTime)
+		}
+		if next := rs.Next; next != nil {
+			rd["NextPID"] = next.Pid()
+			rd["NextOutput"] = next.Output()
+			lastSeq = maxSeq(lastSeq, next.Output())
+		}
 
-	// list failures in reverse-chronological order
-	{
-		f := st.Failures
+		// list failures in reverse-chronological order
+		f := rs.Failures
 		r := make([]*TaskInstance, len(f))
 		for i := range f {
 			r[len(r)-i-1] = f[i]
 		}
-		data["Failures"] = r
+		rd["Failures"] = r
+		replicas = append(replicas, rd)
 	}
+	data["Replicas"] = replicas
+	data["LastSeq"] = lastSeq
 
 	drawTemplate(w, "viewTask", data)
 }
 
+// maxSeq returns the largest of seq and the sequence numbers of lines.
+func maxSeq(seq int64, lines []*Line) int64 {
+	for _, l := range lines {
+		if l.Seq > seq {
+			seq = l.Seq
+		}
+	}
+	return seq
+}
+
 func runWebServer(ln net.Listener) {
 	mux := http.NewServeMux()
 	// TODO: wrap mux in auth handler, making it available only to
@@ -168,6 +250,36 @@ const rootHTML = `
 		.output div.system {
 		   color: #00c;
 		}
+		.output div.match {
+		   background: #ff8;
+		}
+		.output div.level-trace, .output div.level-debug {
+		   color: #888;
+		}
+		.output div.level-warn {
+		   color: #b60;
+		}
+		.output div.level-error, .output div.level-fatal {
+		   color: #c00;
+		}
+		.output span.level {
+		   font-weight: bold;
+		   text-transform: uppercase;
+		}
+		.output div.field {
+		   padding-left: 2em;
+		}
+		.output span.truncated {
+		   font-style: italic;
+		   color: #888;
+		}
+		.history {
+		   font-family: monospace;
+		   font-size: 10pt;
+		}
+		.history td.state {
+		   font-weight: bold;
+		}
                 .topbar {
                     font-family: sans;
                     font-size: 10pt;
@@ -183,6 +295,26 @@ const rootHTML = `
 	</body>
 </html>
 {{end}}
+{{define "lineClass"}}{{.Name}}{{with .Record}}{{with .Level}} level-{{.}}{{end}}{{end}}{{end}}
+{{define "lineData"}}{{with .Record}}{{if .Fields}}<details><summary>{{template "recordSummary" .}}</summary>{{range .Fields}}<div class='field'>{{.Key}}={{.Value}}</div>{{end}}</details>{{else}}{{template "recordSummary" .}}{{end}}{{else}}{{.Data}}{{end}}{{with .TruncationNote}} <span class='truncated'>{{.}}</span>{{end}}{{end}}
+{{define "recordSummary"}}{{with .Level}}<span class='level'>{{.}}</span> {{end}}{{.Message}}{{end}}
+{{define "searchForm"}}
+		<form action='/task/{{.Task.Name}}'>
+		<input type='hidden' name='mode' value='search'>
+		regexp <input name='q' size='30' value='{{.Form.Get "q"}}'>
+		<select name='stream'>
+		<option value=''>all streams</option>
+		{{$stream := .Form.Get "stream"}}
+		{{range $s := "stdout stderr system" | fields}}<option{{if eq $s $stream}} selected{{end}}>{{$s}}</option>{{end}}
+		</select>
+		since <input name='since' size='12' value='{{.Form.Get "since"}}'>
+		until <input name='until' size='12' value='{{.Form.Get "until"}}'>
+		instance <input name='instance' size='12' value='{{.Form.Get "instance"}}'>
+		where <input name='where' size='12' value='{{.Form.Get "where"}}' placeholder='level>=warn'>
+		context <input name='context' size='2' value='{{.Form.Get "context"}}'>
+		<button>search</button>
+		</form>
+{{end}}
 `
 
 var templateHTML = map[string]string{
@@ -203,27 +335,62 @@ var templateHTML = map[string]string{
 		<p>Killed pid {{.PID}}.</p>
 		<p>Back to <a href='/task/{{.Task.Name}}'>{{.Task.Name}} status</a>.</p>
 	{{end}}
+`,
+	"logHistory": `
+	{{define "body"}}
+		<p>Log files in {{.Page.Dir}}. Back to <a href='/task/{{.Task.Name}}'>{{.Task.Name}} status</a>.</p>
+		{{with .Page.Older}}<p><a href='/task/{{$.Task.Name}}?mode=history&amp;before={{.}}'>older</a></p>{{end}}
+		<div class='output'>
+		{{range .Page.Lines}}
+			<div class='{{.Name}}' title='{{.Instance}}'>{{.T.Format "2006-01-02 15:04:05.000"}} {{.Data}}{{with .TruncationNote}} <span class='truncated'>{{.}}</span>{{end}}</div>
+		{{end}}
+		</div>
+		<p><a href='/task/{{.Task.Name}}?mode=history'>newest</a></p>
+	{{end}}
+`,
+	"searchTask": `
+	{{define "body"}}
+		{{template "searchForm" .}}
+		<p>{{.Results.Matches}} matching lines{{if .Results.Truncated}}, stopping at the limit{{end}}.
+		Back to <a href='/task/{{.Task.Name}}'>{{.Task.Name}} status</a>.</p>
+		{{range .Results.Results}}
+		<h2>{{.Kind}}: {{.Instance.ID}}</h2>
+		{{range .Hunks}}
+		<div class='output'>
+		{{range .}}
+			<div class='{{template "lineClass" .Line}}{{if .Match}} match{{end}}' title='{{.T}}'>{{template "lineData" .Line}}</div>
+		{{end}}
+		</div>
+		{{end}}
+		{{end}}
+	{{end}}
 `,
 	"viewTask": `
 	{{define "body"}}
-		<p>{{maybePre .Task.Status.Summary}}</p>
+		<p>{{maybePre .Status.Summary}}</p>
+		{{with .Status.RestartPolicy}}<p>restart policy: {{.}}</p>{{end}}
+		<form method='POST' action='/task/{{.Task.Name}}'>
+		{{if .Running}}<button name='mode' value='stop'>stop</button>
+		{{else}}<button name='mode' value='start'>start</button>{{end}}
+		</form>
 
 		{{with .Cmd}}
 		{{/* TODO: embolden arg[0] */}}
 		<p>command: {{range .Argv}}{{maybeQuote .}} {{end}}</p>
+		{{with .Sched}}<p>scheduling: {{.}}</p>{{end}}
+		{{if .Root}}<p>root: {{.Root}} (binary {{.Path}} is {{.HostPath}} outside it)</p>{{end}}
 		{{end}}
+		{{with .Task.LogDir}}<p>log: {{.}} [<a href='/task/{{$.Task.Name}}?mode=history'>history</a>]</p>{{end}}
+		{{template "searchForm" .}}
 
-		{{if .PID}}
-		<h2>Running Instance</h2>
-                <p>Started {{.StartTime}}, {{.StartAgo}} ago.</p>
-		<p>PID={{.PID}} [<a href='/task/{{.Task.Name}}?pid={{.PID}}&mode=kill'>kill</a>]</p>
+		{{if .MultiReplica}}
+		{{range .Replicas}}
+		<h1>Replica {{.Status.Index}}</h1>
+		<p>{{maybePre .Status.Summary}}</p>
+		{{template "replica" .}}
 		{{end}}
-
-		{{with .Output}}{{template "output" .}}{{end}}
-
-		{{with .Failures}}
-		<h2>Failures</h2>
-		{{range .}}{{template "output" .Output}}{{end}}
+		{{else}}
+		{{range .Replicas}}{{template "replica" .}}{{end}}
 		{{end}}
 
 		<script>
@@ -233,12 +400,123 @@ var templateHTML = map[string]string{
 		     d[i].scrollTop = d[i].scrollHeight;
 		   }
 		});
+
+		// lineDiv renders a streamed line like the "output" template.
+		function lineDiv(l) {
+		   var div = document.createElement("div");
+		   div.className = l.stream;
+		   div.title = l.t;
+		   if (l.msg === undefined) {
+		     div.textContent = l.data;
+		     return truncated(div, l);
+		   }
+		   var summary = div;
+		   if (l.fields.length > 0) {
+		     var details = document.createElement("details");
+		     summary = document.createElement("summary");
+		     details.appendChild(summary);
+		     l.fields.forEach(function(f) {
+		       var fd = document.createElement("div");
+		       fd.className = "field";
+		       fd.textContent = f[0] + "=" + f[1];
+		       details.appendChild(fd);
+		     });
+		     div.appendChild(details);
+		   }
+		   if (l.level) {
+		     div.className += " level-" + l.level;
+		     var span = document.createElement("span");
+		     span.className = "level";
+		     span.textContent = l.level;
+		     summary.appendChild(span);
+		     summary.appendChild(document.createTextNode(" "));
+		   }
+		   summary.appendChild(document.createTextNode(l.msg));
+		   return div;
+		}
+
+		function truncated(div, l) {
+		   if (l.truncated) {
+		     var span = document.createElement("span");
+		     span.className = "truncated";
+		     span.textContent = "[truncated " + l.truncated + " bytes]";
+		     div.appendChild(document.createTextNode(" "));
+		     div.appendChild(span);
+		   }
+		   return div;
+		}
+
+		// Append new output lines as they're streamed, to the
+		// output of the instance they're from or, for a new
+		// instance, of its replica.
+		var es = new EventSource("/task/" + {{.Task.Name}} + "/events?after=" + {{.LastSeq}});
+		es.addEventListener("line", function(e) {
+		   var l = JSON.parse(e.data);
+		   var live = document.querySelector(".live[data-pid='" + l.pid + "']") ||
+		       document.querySelector(".live[data-replica='" + l.replica + "']");
+		   if (!live) {
+		     return;
+		   }
+		   live.setAttribute("data-pid", l.pid);
+		   var out = live.querySelector(".output");
+		   if (!out) {
+		     out = document.createElement("div");
+		     out.className = "output";
+		     live.appendChild(out);
+		   }
+		   var atBottom = out.scrollTop + out.clientHeight >= out.scrollHeight - 5;
+		   out.appendChild(lineDiv(l));
+		   if (atBottom) {
+		     out.scrollTop = out.scrollHeight;
+		   }
+		});
 		</script>
 	{{end}}
+	{{define "replica"}}
+		{{if .PID}}
+		<h2>Running Instance</h2>
+                <p>Started {{.StartTime}}, {{.StartAgo}} ago.</p>
+		<p>PID={{.PID}} [<a href='/task/{{.Task.Name}}?pid={{.PID}}&mode=kill'>kill</a>]</p>
+		{{with .Status.Process}}<p>process: {{.}}</p>{{end}}
+		{{with .Status.Health}}<p>health: {{.}}</p>{{end}}
+		{{with .Status.ChildStatus}}<p>status: {{.}}</p>{{end}}
+		{{with .Status.Resources}}<p>resources: {{.}}</p>{{end}}
+		{{with .Status.Capabilities}}<p>capabilities: {{.}}</p>{{end}}
+		{{with .Status.Descendants}}<p>descendants: {{range $i, $p := .}}{{if $i}}, {{end}}{{$p}}{{end}}</p>{{end}}
+		{{end}}
+
+		{{if .NextPID}}
+		<h2>Rolling Out</h2>
+		<p>PID={{.NextPID}}, waiting to become ready before replacing PID {{.PID}}.</p>
+		<div class='live' data-pid='{{.NextPID}}'>{{with .NextOutput}}{{template "output" .}}{{end}}</div>
+		{{end}}
+
+		<div class='live' data-pid='{{with .PID}}{{.}}{{end}}' data-replica='{{.Status.Index}}'>{{with .Output}}{{template "output" .}}{{end}}</div>
+
+		{{with .Status.Completed}}
+		<h2>Last Completed</h2>
+		{{with .Exit}}<p>exit: {{.}}</p>{{end}}
+		{{template "output" .Output}}
+		{{end}}
+
+		{{with .Failures}}
+		<h2>Failures</h2>
+		{{range .}}{{with .Exit}}<p>exit: {{.}}</p>{{end}}{{with .ExitReason}}<p>exit reason: {{.}}</p>{{end}}{{template "output" .Output}}{{end}}
+		{{end}}
+
+		{{with .Status.History}}
+		<h2>State history</h2>
+		<table class='history'>
+		{{range .}}
+			<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td class='state'>{{.State}}</td><td>{{.Reason}}</td></tr>
+		{{end}}
+		</table>
+		{{end}}
+	{{end}}
 	{{define "output"}}
 		<div class='output'>
 		{{range .}}
-			<div class='{{.Name}}' title='{{.T}}'>{{.Data}}</div>
+			<div class='{{template "lineClass" .}}' title='{{.T}}'>{{template "lineData" .}}</div>
 		{{end}}
 		</div>
 	{{end}}
@@ -248,6 +526,7 @@ var templateHTML = map[string]string{
 var templateFuncs = template.FuncMap{
 	"maybeQuote": maybeQuote,
 	"maybePre":   maybePre,
+	"fields":     strings.Fields,
 }
 
 func maybeQuote(s string) string {
@@ -0,0 +1,77 @@
+// Package notify lets a process running under runsit tell runsit
+// about its state, such as when it's finished starting up.
+//
+// Messages use the sd_notify wire format: newline-separated
+// KEY=VALUE assignments, such as "READY=1" or "STATUS=loading
+// index", one message per datagram. They're written to the fd named
+// by the RUNSIT_NOTIFY_FD environment variable.
+package notify
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	once sync.Once
+	f    *os.File
+	err  error
+)
+
+func notifyFile() (*os.File, error) {
+	once.Do(func() {
+		s := os.Getenv("RUNSIT_NOTIFY_FD")
+		if s == "" {
+			return
+		}
+		fd, perr := strconv.ParseUint(s, 10, 32)
+		if perr != nil {
+			err = fmt.Errorf("notify: invalid RUNSIT_NOTIFY_FD %q: %v", s, perr)
+			return
+		}
+		f = os.NewFile(uintptr(fd), "runsit notify fd")
+	})
+	return f, err
+}
+
+// Send sends state, one or more newline-separated KEY=VALUE
+// assignments, to runsit. If the process isn't running under runsit,
+// Send does nothing and returns nil.
+func Send(state string) error {
+	f, err := notifyFile()
+	if f == nil || err != nil {
+		return err
+	}
+	_, err = f.Write([]byte(state))
+	return err
+}
+
+// Ready tells runsit the process has finished starting up.
+func Ready() error {
+	return Send("READY=1")
+}
+
+// Status sets the status string shown for the process on runsit's
+// task page.
+func Status(status string) error {
+	return Send("STATUS=" + status)
+}
+
+// Watchdog sends runsit a keepalive. Tasks with a watchdogInterval
+// must send one at least that often or be restarted as hung.
+func Watchdog() error {
+	return Send("WATCHDOG=1")
+}
+
+// WatchdogInterval returns the task's watchdogInterval, or zero if it
+// has none. Sending keepalives every half interval is typical.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("RUNSIT_WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
@@ -0,0 +1,119 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// capNames are the Linux capabilities, indexed by number.
+var capNames = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_DAC_READ_SEARCH",
+	"CAP_FOWNER",
+	"CAP_FSETID",
+	"CAP_KILL",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETPCAP",
+	"CAP_LINUX_IMMUTABLE",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_NET_BROADCAST",
+	"CAP_NET_ADMIN",
+	"CAP_NET_RAW",
+	"CAP_IPC_LOCK",
+	"CAP_IPC_OWNER",
+	"CAP_SYS_MODULE",
+	"CAP_SYS_RAWIO",
+	"CAP_SYS_CHROOT",
+	"CAP_SYS_PTRACE",
+	"CAP_SYS_PACCT",
+	"CAP_SYS_ADMIN",
+	"CAP_SYS_BOOT",
+	"CAP_SYS_NICE",
+	"CAP_SYS_RESOURCE",
+	"CAP_SYS_TIME",
+	"CAP_SYS_TTY_CONFIG",
+	"CAP_MKNOD",
+	"CAP_LEASE",
+	"CAP_AUDIT_WRITE",
+	"CAP_AUDIT_CONTROL",
+	"CAP_SETFCAP",
+	"CAP_MAC_OVERRIDE",
+	"CAP_MAC_ADMIN",
+	"CAP_SYSLOG",
+	"CAP_WAKE_ALARM",
+	"CAP_BLOCK_SUSPEND",
+	"CAP_AUDIT_READ",
+	"CAP_PERFMON",
+	"CAP_BPF",
+	"CAP_CHECKPOINT_RESTORE",
+}
+
+// parseCapabilities parses a task's "capabilities" list, of names
+// such as "CAP_NET_BIND_SERVICE" or "net_bind_service", into
+// capability numbers.
+func parseCapabilities(names []string) ([]int, error) {
+	if runtime.GOOS != "linux" {
+		return nil, errors.New("only supported on Linux")
+	}
+	var caps []int
+	for _, name := range names {
+		want := strings.ToUpper(name)
+		if !strings.HasPrefix(want, "CAP_") {
+			want = "CAP_" + want
+		}
+		found := false
+		for n, cn := range capNames {
+			if cn == want {
+				caps = append(caps, n)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown capability %q", name)
+		}
+	}
+	return caps, nil
+}
+
+// effectiveCaps returns the names of the effective capabilities of
+// process pid, "all" if it has all of them, or "none".
+func effectiveCaps(pid int) (string, error) {
+	mask, err := effectiveCapMask(pid)
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for n, cn := range capNames {
+		if mask&(1<<uint(n)) != 0 {
+			names = append(names, strings.ToLower(cn))
+		}
+	}
+	switch len(names) {
+	case 0:
+		return "none", nil
+	case len(capNames):
+		return "all", nil
+	}
+	return strings.Join(names, ", "), nil
+}
+
+// effectiveCapMask returns the effective capabilities of process pid,
+// with bit n set for capability n.
+func effectiveCapMask(pid int) (uint64, error) {
+	status, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, "CapEff:") {
+			return strconv.ParseUint(strings.TrimSpace(line[len("CapEff:"):]), 16, 64)
+		}
+	}
+	return 0, errors.New("no CapEff in status")
+}
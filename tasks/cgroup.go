@@ -0,0 +1,385 @@
+package tasks
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/runsit/jsonconfig"
+)
+
+// CgroupRoot is the cgroup v2 directory under which runsit creates
+// task cgroups. If empty, runsit uses its own cgroup.
+var CgroupRoot string
+
+// cgroupLimits is a task's parsed cgroup config: its "memoryMax",
+// "cpuWeight", "cpuMax", "pidsMax" and "ioWeight" keys. Each
+// instance of such a task runs in a cgroup of its own with these
+// limits.
+type cgroupLimits struct {
+	memoryMax string // as configured, such as "512M"; or empty
+	cpuWeight int    // 1 to 10000, or 0 to not set
+	cpuMax    string // as configured, such as "150%"; or empty
+	pidsMax   int    // or 0 to not set
+	ioWeight  int    // 1 to 10000, or 0 to not set
+
+	files map[string]string // cgroup file name -> value to write
+}
+
+// parseCgroupLimits parses a task's cgroup config keys. It returns nil
+// if the task has none and its "cgroup" key, which enables a cgroup
+// just for its resource accounting, isn't set.
+func parseCgroupLimits(jc jsonconfig.Obj) (*cgroupLimits, error) {
+	cl := &cgroupLimits{
+		memoryMax: jc.OptionalString("memoryMax", ""),
+		cpuWeight: jc.OptionalInt("cpuWeight", 0),
+		cpuMax:    jc.OptionalString("cpuMax", ""),
+		pidsMax:   jc.OptionalInt("pidsMax", 0),
+		ioWeight:  jc.OptionalInt("ioWeight", 0),
+		files:     make(map[string]string),
+	}
+	enabled := jc.OptionalBool("cgroup", false)
+	if cl.memoryMax != "" {
+		n, err := parseMemorySize(cl.memoryMax)
+		if err != nil {
+			return nil, fmt.Errorf("memoryMax: %v", err)
+		}
+		cl.files["memory.max"] = n
+	}
+	if cl.cpuMax != "" {
+		v, err := parseCPUMax(cl.cpuMax)
+		if err != nil {
+			return nil, fmt.Errorf("cpuMax: %v", err)
+		}
+		cl.files["cpu.max"] = v
+	}
+	for _, w := range []struct {
+		key, file string
+		v         int
+	}{
+		{"cpuWeight", "cpu.weight", cl.cpuWeight},
+		{"ioWeight", "io.weight", cl.ioWeight},
+	} {
+		if w.v == 0 {
+			continue
+		}
+		if w.v < 1 || w.v > 10000 {
+			return nil, fmt.Errorf("%s must be between 1 and 10000", w.key)
+		}
+		cl.files[w.file] = strconv.Itoa(w.v)
+	}
+	if cl.pidsMax < 0 {
+		return nil, errors.New("pidsMax must be positive")
+	}
+	if cl.pidsMax > 0 {
+		cl.files["pids.max"] = strconv.Itoa(cl.pidsMax)
+	}
+	if len(cl.files) == 0 && !enabled {
+		return nil, nil
+	}
+	return cl, nil
+}
+
+// parseMemorySize parses a size like "512M" into the value to write to
+// memory.max. Suffixes K, M, G and T are powers of 1024.
+func parseMemorySize(s string) (string, error) {
+	if s == "max" {
+		return s, nil
+	}
+	mult := int64(1)
+	num := strings.TrimSuffix(strings.ToUpper(s), "B")
+	if i := strings.IndexAny(num, "KMGT"); i >= 0 && i == len(num)-1 {
+		mult = 1 << (10 * uint(strings.IndexByte("KMGT", num[i])+1))
+		num = num[:i]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 {
+		return "", fmt.Errorf("invalid size %q; want bytes, a size like \"512M\", or \"max\"", s)
+	}
+	if n > math.MaxInt64/mult {
+		return "", fmt.Errorf("size %q is too large", s)
+	}
+	return strconv.FormatInt(n*mult, 10), nil
+}
+
+// parseCPUMax parses a cpuMax value: "max", a percentage of one CPU
+// such as "150%", or cpu.max's own "$QUOTA $PERIOD" form.
+func parseCPUMax(s string) (string, error) {
+	const (
+		period   = 100000 // microseconds; the kernel's default
+		minQuota = 1000   // microseconds; the kernel rejects less
+	)
+	if s == "max" {
+		return s, nil
+	}
+	if strings.HasSuffix(s, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || pct <= 0 {
+			return "", fmt.Errorf("invalid percentage %q", s)
+		}
+		quota := pct * period / 100
+		if quota < minQuota {
+			return "", fmt.Errorf("percentage %q is under the minimum of %d%%", s, minQuota*100/period)
+		}
+		if quota >= math.MaxInt64 {
+			return "", fmt.Errorf("percentage %q is too large", s)
+		}
+		return fmt.Sprintf("%d %d", int64(quota), period), nil
+	}
+	f := strings.Fields(s)
+	if len(f) == 2 {
+		quota, qerr := strconv.ParseUint(f[0], 10, 64)
+		_, perr := strconv.ParseUint(f[1], 10, 64)
+		if qerr == nil && quota < minQuota {
+			return "", fmt.Errorf("quota in %q is under the minimum of %dus", s, minQuota)
+		}
+		if (qerr == nil || f[0] == "max") && perr == nil {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("invalid value %q; want \"max\", a percentage like \"150%%\", or \"$QUOTA $PERIOD\"", s)
+}
+
+var (
+	cgroupOnce sync.Once
+	cgroupBase string // directory task cgroups are created in
+	cgroupErr  error
+)
+
+// taskCgroupBase returns the directory runsit creates task cgroups
+// in, setting it up the first time it's called.
+func taskCgroupBase() (string, error) {
+	cgroupOnce.Do(func() {
+		cgroupBase, cgroupErr = setupCgroups()
+		if cgroupErr != nil {
+			cgroupErr = fmt.Errorf("cgroup setup: %v", cgroupErr)
+		}
+	})
+	return cgroupBase, cgroupErr
+}
+
+func setupCgroups() (string, error) {
+	root := CgroupRoot
+	if root == "" {
+		var err error
+		if root, err = ownCgroup(); err != nil {
+			return "", err
+		}
+	}
+	// cgroup v2 doesn't allow a cgroup with processes of its own
+	// to enable controllers for its children, so if runsit is in
+	// root, it moves to a leaf cgroup of its own first.
+	procs, err := ioutil.ReadFile(filepath.Join(root, "cgroup.procs"))
+	if err != nil {
+		return "", err
+	}
+	for _, pid := range strings.Fields(string(procs)) {
+		if pid != strconv.Itoa(os.Getpid()) {
+			continue
+		}
+		self := filepath.Join(root, "runsit")
+		if err := os.MkdirAll(self, 0755); err != nil {
+			return "", err
+		}
+		if err := writeCgroupFile(self, "cgroup.procs", pid); err != nil {
+			return "", err
+		}
+	}
+	base := filepath.Join(root, "tasks")
+	if err := makeCgroup(base); err != nil {
+		return "", err
+	}
+	enableControllers(root)
+	enableControllers(base)
+	return base, nil
+}
+
+// ownCgroup returns the directory of runsit's own cgroup v2 cgroup.
+func ownCgroup() (string, error) {
+	cg, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	var path string
+	for _, line := range strings.Split(string(cg), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			path = line[len("0::"):]
+		}
+	}
+	if path == "" {
+		return "", errors.New("not in a cgroup v2 hierarchy")
+	}
+	mi, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer mi.Close()
+	s := bufio.NewScanner(mi)
+	for s.Scan() {
+		// Fields: id parent maj:min root mountpoint opts... - fstype source superopts
+		f := strings.Fields(s.Text())
+		for i := 6; i+1 < len(f); i++ {
+			if f[i] == "-" && f[i+1] == "cgroup2" {
+				return filepath.Join(f[4], path), nil
+			}
+		}
+	}
+	return "", errors.New("no cgroup2 filesystem mounted")
+}
+
+func makeCgroup(dir string) error {
+	err := os.Mkdir(dir, 0755)
+	if os.IsExist(err) {
+		return nil
+	}
+	return err
+}
+
+// enableControllers enables, for dir's children, whichever of the
+// controllers runsit sets limits with are available. Limits whose
+// controllers aren't available fail when the limit is written.
+func enableControllers(dir string) {
+	avail, _ := ioutil.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	for _, c := range strings.Fields(string(avail)) {
+		switch c {
+		case "cpu", "io", "memory", "pids":
+			writeCgroupFile(dir, "cgroup.subtree_control", "+"+c)
+		}
+	}
+}
+
+func writeCgroupFile(dir, file, value string) error {
+	f, err := os.OpenFile(filepath.Join(dir, file), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte(value))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// newCgroup creates a cgroup for an instance of task, with the limits
+// cl, and returns its directory. The instance joins it before exec;
+// see LaunchRequest.Cgroup.
+func newCgroup(task string, replica int, cl *cgroupLimits) (string, error) {
+	base, err := taskCgroupBase()
+	if err != nil {
+		return "", err
+	}
+	taskDir := filepath.Join(base, task)
+	if err := makeCgroup(taskDir); err != nil {
+		return "", err
+	}
+	enableControllers(taskDir)
+	dir := filepath.Join(taskDir, fmt.Sprintf("r%d-%d", replica, time.Now().UnixNano()))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", err
+	}
+	for file, v := range cl.files {
+		if err := writeCgroupFile(dir, file, v); err != nil {
+			os.Remove(dir)
+			if os.IsNotExist(err) {
+				err = fmt.Errorf("%s controller not available", strings.Split(file, ".")[0])
+			}
+			return "", fmt.Errorf("setting %s: %v", file, err)
+		}
+	}
+	return dir, nil
+}
+
+// CgroupStats is the resource usage of an instance's cgroup. Fields
+// whose controllers aren't enabled are zero.
+type CgroupStats struct {
+	MemoryCurrent int64         // bytes
+	MemoryPeak    int64         // bytes; needs Linux 5.19 or later
+	CPUUsage      time.Duration // total CPU time used
+	Pids          int64         // number of processes and threads; always set
+	OOMKills      int64         // processes killed for exceeding memory.max
+}
+
+func (s *CgroupStats) String() string {
+	str := fmt.Sprintf("memory %s, CPU %v, %d tasks", byteSize(s.MemoryCurrent), roundDuration(s.CPUUsage), s.Pids)
+	if s.MemoryPeak > 0 {
+		str += fmt.Sprintf(", peak memory %s", byteSize(s.MemoryPeak))
+	}
+	if s.OOMKills > 0 {
+		str += fmt.Sprintf(", %d OOM kills", s.OOMKills)
+	}
+	return str
+}
+
+func byteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGT"[exp])
+}
+
+// readCgroupStats reads the resource usage of the cgroup in dir.
+func readCgroupStats(dir string) *CgroupStats {
+	s := new(CgroupStats)
+	s.MemoryCurrent = readCgroupInt(dir, "memory.current")
+	s.MemoryPeak = readCgroupInt(dir, "memory.peak")
+	s.Pids = readCgroupInt(dir, "pids.current")
+	if s.Pids == 0 {
+		// No pids controller; count them instead.
+		threads, _ := ioutil.ReadFile(filepath.Join(dir, "cgroup.threads"))
+		s.Pids = int64(len(strings.Fields(string(threads))))
+	}
+	s.CPUUsage = time.Duration(readCgroupKey(dir, "cpu.stat", "usage_usec")) * time.Microsecond
+	s.OOMKills = readCgroupKey(dir, "memory.events", "oom_kill")
+	return s
+}
+
+func readCgroupInt(dir, file string) int64 {
+	b, _ := ioutil.ReadFile(filepath.Join(dir, file))
+	n, _ := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	return n
+}
+
+// readCgroupKey returns the value of key in a flat keyed cgroup file,
+// such as cpu.stat.
+func readCgroupKey(dir, file, key string) int64 {
+	b, _ := ioutil.ReadFile(filepath.Join(dir, file))
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 2 && f[0] == key {
+			n, _ := strconv.ParseInt(f[1], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// cgroupProcs returns the pids of the processes in cgroup dir.
+func cgroupProcs(dir string) []int {
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	var pids []int
+	for _, f := range strings.Fields(string(b)) {
+		if pid, err := strconv.Atoi(f); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// removeCgroup removes an instance's cgroup after it exits.
+func removeCgroup(dir string) error {
+	return os.Remove(dir)
+}
@@ -0,0 +1,155 @@
+package tasks
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// depPollInterval is how often a task waiting on its dependencies
+// checks them again.
+const depPollInterval = 1 * time.Second
+
+// publish updates the state that other tasks' loops may read, for
+// dependency checking, without going through t.loop.
+// run in Task.loop
+func (t *Task) publish() {
+	ready := true
+	state := t.replicas[0].state
+	for _, r := range t.replicas {
+		if !r.ready() {
+			if ready {
+				state = r.state
+			}
+			ready = false
+		}
+	}
+	t.pubMu.Lock()
+	defer t.pubMu.Unlock()
+	t.pubState = state
+	t.pubReady = ready
+}
+
+// setDeps sets the names of the tasks t depends on, from its
+// "requires" and "after" config keys.
+func (t *Task) setDeps(requires, after []string) {
+	t.pubMu.Lock()
+	defer t.pubMu.Unlock()
+	t.pubRequires = requires
+	t.pubAfter = after
+}
+
+// deps returns the names of the tasks t depends on, either way.
+func (t *Task) deps() []string {
+	t.pubMu.Lock()
+	defer t.pubMu.Unlock()
+	return append(append([]string(nil), t.pubRequires...), t.pubAfter...)
+}
+
+// ready reports whether all of t's replicas are running and, if it
+// has a health check, healthy. Also returned is the state of the
+// first replica that isn't ready, if any.
+func (t *Task) ready() (bool, TaskState) {
+	t.pubMu.Lock()
+	defer t.pubMu.Unlock()
+	return t.pubReady, t.pubState
+}
+
+// checkDeps returns the names of the dependencies t is still waiting
+// on. A non-nil error means the dependencies can't ever be satisfied
+// as configured.
+// run in Task.loop
+func (t *Task) checkDeps(requires, after []string) (waiting []string, err error) {
+	if cycle := t.depCycle(); cycle != nil {
+		return nil, fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+	}
+	for _, name := range requires {
+		dep, ok := GetTask(name)
+		if !ok {
+			return nil, fmt.Errorf("required task %q not found", name)
+		}
+		if ready, _ := dep.ready(); !ready {
+			waiting = append(waiting, name)
+		}
+	}
+	for _, name := range after {
+		dep, ok := GetTask(name)
+		if !ok {
+			return nil, fmt.Errorf("after task %q not found", name)
+		}
+		ready, state := dep.ready()
+		if ready {
+			continue
+		}
+		switch state {
+		case StateStopped, StateExited, StateFatal, StateConfigError, StateStartError:
+			// Not coming up any time soon; "after" only
+			// orders, so don't wait for it.
+		default:
+			waiting = append(waiting, name)
+		}
+	}
+	return waiting, nil
+}
+
+// depCycle returns a dependency cycle through t, starting and ending
+// with t's name, or nil if there isn't one.
+func (t *Task) depCycle() []string {
+	visited := map[string]bool{}
+	var path []string
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		path = append(path, name)
+		if len(path) > 1 && name == t.Name {
+			return true
+		}
+		if !visited[name] {
+			visited[name] = true
+			if dep, ok := GetTask(name); ok {
+				for _, d := range dep.deps() {
+					if visit(d) {
+						return true
+					}
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if visit(t.Name) {
+		return path
+	}
+	return nil
+}
+
+// StopOrder returns tasks ordered such that each task comes before
+// the tasks it depends on, so they can be stopped in that order.
+func StopOrder(tasks []*Task) []*Task {
+	byName := make(map[string]*Task)
+	for _, t := range tasks {
+		byName[t.Name] = t
+	}
+	var start []*Task // dependencies first
+	visited := map[*Task]bool{}
+	var visit func(t *Task)
+	visit = func(t *Task) {
+		if visited[t] {
+			return
+		}
+		visited[t] = true
+		for _, name := range t.deps() {
+			if dep, ok := byName[name]; ok {
+				visit(dep)
+			}
+		}
+		start = append(start, t)
+	}
+	for _, t := range tasks {
+		visit(t)
+	}
+	stop := make([]*Task, len(start))
+	for i, t := range start {
+		stop[len(stop)-1-i] = t
+	}
+	return stop
+}
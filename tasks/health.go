@@ -0,0 +1,287 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bradfitz/runsit/jsonconfig"
+)
+
+// healthCheck is the parsed "healthCheck" config block of a task.
+type healthCheck struct {
+	kind        string        // "http", "tcp" or "exec"
+	port        string        // for http and tcp: name of the port to dial
+	path        string        // for http: path to GET
+	argv        []string      // for exec: command to run
+	interval    time.Duration // between checks
+	timeout     time.Duration // per check
+	threshold   int           // consecutive failures before the instance is unhealthy
+	startPeriod time.Duration // grace period after start before checking
+	restart     bool          // whether to restart unhealthy instances
+}
+
+// HealthStatus is the result of a running instance's recent health
+// checks.
+type HealthStatus struct {
+	Checked  time.Time // time of the last check, or zero if none yet
+	Healthy  bool      // whether the last check passed
+	Failures int       // consecutive failed checks
+	Err      error     // error from the last failed check
+}
+
+func (hs HealthStatus) String() string {
+	switch {
+	case hs.Checked.IsZero():
+		return "not checked yet"
+	case hs.Healthy:
+		return "healthy"
+	}
+	return fmt.Sprintf("%d consecutive failed health checks; last: %v", hs.Failures, hs.Err)
+}
+
+// parseHealthCheck parses a task's "healthCheck" config block, or
+// returns nil if there was none. ports are the task's ports.
+func parseHealthCheck(jc jsonconfig.Obj, ports []*portSpec) (*healthCheck, error) {
+	if len(jc) == 0 {
+		return nil, nil
+	}
+	hc := &healthCheck{
+		kind:        jc.RequiredString("type"),
+		interval:    jc.OptionalDuration("interval", 10*time.Second),
+		timeout:     jc.OptionalDuration("timeout", 2*time.Second),
+		threshold:   jc.OptionalInt("failureThreshold", 3),
+		startPeriod: jc.OptionalDuration("startPeriod", 0),
+		restart:     jc.OptionalBool("restart", true),
+	}
+	switch hc.kind {
+	case "http":
+		hc.port = jc.RequiredString("port")
+		hc.path = jc.OptionalString("path", "/")
+	case "tcp":
+		hc.port = jc.RequiredString("port")
+	case "exec":
+		hc.argv = jc.RequiredList("command")
+	}
+	if err := jc.Validate(); err != nil {
+		return nil, err
+	}
+	switch hc.kind {
+	case "http", "tcp":
+		found := false
+		for _, ps := range ports {
+			found = found || ps.name == hc.port
+		}
+		if !found {
+			return nil, fmt.Errorf("port %q not defined in ports", hc.port)
+		}
+	case "exec":
+		if len(hc.argv) == 0 {
+			return nil, errors.New("empty command")
+		}
+	default:
+		return nil, fmt.Errorf("unknown type %q; want \"http\", \"tcp\" or \"exec\"", hc.kind)
+	}
+	if hc.interval <= 0 || hc.timeout <= 0 || hc.threshold < 1 {
+		return nil, errors.New("interval, timeout and failureThreshold must be positive")
+	}
+	return hc, nil
+}
+
+// dialAddr returns the address to dial to reach a listener on addr,
+// replacing an unspecified IP with localhost.
+func dialAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// check runs the health check once against instance in.
+func (hc *healthCheck) check(in *TaskInstance) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.timeout)
+	defer cancel()
+	switch hc.kind {
+	case "tcp":
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "tcp", in.portAddrs[hc.port])
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	case "http":
+		req, err := http.NewRequest("GET", "http://"+in.portAddrs[hc.port]+hc.path, nil)
+		if err != nil {
+			return err
+		}
+		res, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode >= 400 {
+			return fmt.Errorf("GET %s: %s", hc.path, res.Status)
+		}
+		return nil
+	case "exec":
+		return hc.checkExec(in)
+	}
+	panic("unknown health check type " + hc.kind)
+}
+
+// checkExec runs the exec health check's command for in the way
+// in itself was run: through the child process, with its user, root,
+// sandbox, cgroup, limits and capabilities. With a network sandbox,
+// the command only has a loopback interface of its own.
+func (hc *healthCheck) checkExec(in *TaskInstance) error {
+	lr, err := hc.launchRequest(in)
+	if err != nil {
+		return err
+	}
+	cmd, outPipe, errPipe, err := lr.start(nil)
+	if err != nil {
+		return err
+	}
+	var stdout, stderr bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { io.Copy(&stdout, outPipe); wg.Done() }()
+	go func() { io.Copy(&stderr, errPipe); wg.Done() }()
+	timer := time.AfterFunc(hc.timeout, func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) // its process group
+	})
+	wg.Wait()
+	err = cmd.Wait()
+	cmdWaited(cmd)
+	if !timer.Stop() {
+		err = fmt.Errorf("timed out after %v", hc.timeout)
+	}
+	if err == nil {
+		return nil
+	}
+	if out := append(stdout.Bytes(), stderr.Bytes()...); len(out) > 0 {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return err
+}
+
+// launchRequest returns the LaunchRequest for running the exec health
+// check's command for in: its own, with the command instead, and
+// without the fds the command doesn't get.
+func (hc *healthCheck) launchRequest(in *TaskInstance) (*LaunchRequest, error) {
+	lr := *in.Lr
+	lr.Argv = hc.argv
+	lr.Path = hc.argv[0]
+	lr.Env = nil
+	for _, kv := range in.Lr.Env {
+		if strings.HasPrefix(kv, "RUNSIT_PORTFD_") || strings.HasPrefix(kv, "RUNSIT_NOTIFY_FD=") || strings.HasPrefix(kv, "RUNSIT_WATCHDOG_USEC=") {
+			continue
+		}
+		lr.Env = append(lr.Env, kv)
+	}
+	if !strings.Contains(lr.Path, "/") {
+		path, err := lookPath(lr.Path, lr.Env, lr.Root)
+		if err != nil {
+			return nil, err
+		}
+		lr.Path = path
+	}
+	return &lr, nil
+}
+
+// lookPath finds the executable name in the directories of env's
+// PATH, as seen from within root, if set; the child only execs paths.
+func lookPath(name string, env []string, root string) (string, error) {
+	var path string
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			path = kv[len("PATH="):]
+		}
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		p := filepath.Join(dir, name)
+		if fi, err := os.Stat(filepath.Join(root, p)); err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%q not found in the task's PATH", name)
+}
+
+// watchHealth periodically runs the instance's health check until
+// the instance exits, reporting each result to Task.loop.
+// run in its own goroutine
+func (in *TaskInstance) watchHealth() {
+	hc := in.healthCheck
+	wait := hc.startPeriod
+	for {
+		select {
+		case <-time.After(wait):
+		case <-in.done:
+			return
+		}
+		err := hc.check(in)
+		select {
+		case in.task.controlc <- healthResultMessage{in, err}:
+		case <-in.done:
+			return
+		}
+		wait = hc.interval
+	}
+}
+
+// run in Task.loop
+func (t *Task) onHealthResult(m healthResultMessage) {
+	in := m.in
+	r := in.replica
+	if in != r.running && in != r.next {
+		return
+	}
+	hs := &in.health
+	hs.Checked = time.Now()
+	if m.err == nil {
+		if !hs.Healthy {
+			in.Printf("health check passed")
+		}
+		hs.Healthy = true
+		hs.Failures = 0
+		hs.Err = nil
+		t.onInstanceReady(in)
+		return
+	}
+	hs.Healthy = false
+	hs.Failures++
+	hs.Err = m.err
+	hc := in.healthCheck
+	in.Printf("health check failed (%d/%d): %v", hs.Failures, hc.threshold, m.err)
+	if hs.Failures < hc.threshold || in == r.next {
+		// A next instance gets until its readyTimeout.
+		return
+	}
+	if !hc.restart {
+		if hs.Failures == hc.threshold {
+			in.Printf("unhealthy; not restarting")
+		}
+		return
+	}
+	in.failReason = fmt.Sprintf("unhealthy after %d failed health checks", hs.Failures)
+	in.Printf("%s; restarting", in.failReason)
+	t.stopReplicas([]*replica{r})
+	t.afterExit(in, true)
+}
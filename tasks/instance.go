@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"os/exec"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/bradfitz/runsit/jsonconfig"
@@ -14,15 +16,56 @@ import (
 // TaskInstance is a particular instance of a running (or now dead) Task.
 type TaskInstance struct {
 	task      *Task          // set once; not goroutine safe (may only call public methods)
+	replica   *replica       // set once; owned by Task.loop
 	StartTime time.Time      // set once; immutable
 	config    jsonconfig.Obj // set once; immutable
 	Lr        *LaunchRequest // set once; immutable (actual command parameters)
 	cmd       *exec.Cmd      // set once; immutable (command parameters to helper process)
 	output    TaskOutput     // internal locking, safe for concurrent access
 
+	stopSignal    syscall.Signal    // set once; immutable (first signal sent by stop)
+	stopTimeout   time.Duration     // set once; immutable (time before stop escalates to SIGKILL)
+	restart       *restartPolicy    // set once; immutable
+	oneshot       bool              // set once; immutable (whether its task is of type "oneshot")
+	successCodes  []int             // set once; immutable (exit codes that aren't failures)
+	healthCheck   *healthCheck      // set once; immutable; or nil
+	rollout       *rolloutConfig    // set once; immutable
+	readyNotify   bool              // set once; immutable (whether ready requires a READY=1 notification)
+	watchdog      time.Duration     // set once; immutable (max time between keepalives, or 0)
+	logFormat     string            // set once; immutable (how to parse its output lines)
+	maxLineLength int               // set once; immutable (bytes of each output line to keep)
+	cgroupConf    *cgroupLimits     // set once; immutable; or nil
+	cgroup        string            // set before start; immutable (directory of its cgroup, or empty)
+	health        HealthStatus      // owned by Task.loop
+	portAddrs     map[string]string // set before start; immutable (port name -> dialable address)
+
+	// Owned by Task.loop, from the instance's notify messages:
+	notifiedReady bool   // whether it sent READY=1
+	childStatus   string // last STATUS= value
+
+	// Owned by Task.loop; see armWatchdog:
+	watchdogTimer *time.Timer
+	watchdogGen   int
+
+	descMu      sync.Mutex
+	descendants map[int]*proc // guarded by descMu; see scanDescendants
+
+	sampleMu sync.Mutex
+	sample   *ProcSample // guarded by sampleMu; see sampleProc
+
+	// failReason is why runsit stopped the instance as failed, such
+	// as a missed keepalive, or empty. Set before it's stopped, so
+	// immutable once it's in its replica's failures.
+	failReason string
+
+	done chan struct{} // closed by awaitDeath, after endTime and waitErr are set
+
 	// Set (in awaitDeath) when task finishes running:
-	endTime time.Time
-	waitErr error // typically nil or *exec.ExitError
+	endTime    time.Time
+	waitErr    error        // typically nil or *exec.ExitError
+	exit       *ExitInfo    // how it exited, if it ran
+	exitReason string       // why it exited, if known beyond waitErr, such as an OOM kill
+	finalStats *CgroupStats // resource usage, if it had a cgroup
 }
 
 // ID returns a unique ID string for this task instance.
@@ -41,6 +84,31 @@ func (in *TaskInstance) Printf(format string, args ...interface{}) {
 	Logger.Print(msg)
 }
 
+// ready reports whether the instance has notified runsit it's ready,
+// if it's configured to, and passed its health check, if it has one.
+// A oneshot instance is never ready; its replica is once it completes.
+// run in Task.loop
+func (in *TaskInstance) ready() bool {
+	return !in.oneshot && (!in.readyNotify || in.notifiedReady) && (in.healthCheck == nil || in.health.Healthy)
+}
+
+// ExitReason returns why the instance exited, if known beyond its
+// exit status: that runsit stopped it as failed, or that it was
+// killed for running out of memory. Only valid once the instance has
+// finished.
+func (in *TaskInstance) ExitReason() string {
+	if in.failReason != "" {
+		return in.failReason
+	}
+	return in.exitReason
+}
+
+// Exit returns how the instance exited, or nil if it didn't run. Only
+// valid once the instance has finished.
+func (in *TaskInstance) Exit() *ExitInfo {
+	return in.exit
+}
+
 func (in *TaskInstance) Pid() int {
 	if in.cmd == nil || in.cmd.Process == nil {
 		return 0
@@ -55,15 +123,44 @@ func (in *TaskInstance) Output() []*Line {
 // run in its own goroutine
 func (in *TaskInstance) awaitDeath() {
 	in.waitErr = in.cmd.Wait()
+	cmdWaited(in.cmd)
 	in.endTime = time.Now()
+	if ps := in.cmd.ProcessState; ps != nil {
+		in.exit = newExitInfo(ps, in.endTime.Sub(in.StartTime))
+	}
+	in.killDescendants()
+	if in.cgroup != "" {
+		in.finalStats = readCgroupStats(in.cgroup)
+		if in.finalStats.OOMKills > 0 {
+			in.exitReason = "killed by OOM"
+			if max := in.cgroupConf.memoryMax; max != "" {
+				in.exitReason = fmt.Sprintf("killed by OOM (memory.max=%s)", max)
+			}
+		}
+		if err := removeCgroup(in.cgroup); err != nil {
+			in.Printf("failed to remove cgroup: %v", err)
+		}
+	}
+	close(in.done)
 	in.task.controlc <- instanceGoneMessage{in}
 }
 
+// signal sends sig to the instance's entire process group.
+func (in *TaskInstance) signal(sig syscall.Signal) {
+	in.Printf("sending %s", signalName(sig))
+
+	// Was: in.cmd.Process.Signal(sig); but we want to signal
+	// the entire process group.
+	processGroup := 0 - in.Pid()
+	rv := syscall.Kill(processGroup, sig)
+	in.Printf("Kill result: %v", rv)
+}
+
 // run in its own goroutine
 func (in *TaskInstance) watchPipe(r io.Reader, name string) {
 	br := bufio.NewReader(r)
 	for {
-		sl, isPrefix, err := br.ReadLine()
+		sl, truncated, err := readLine(br, in.maxLineLength)
 		if err == io.EOF {
 			// Not worth logging about.
 			return
@@ -72,13 +169,20 @@ func (in *TaskInstance) watchPipe(r io.Reader, name string) {
 			in.Printf("pipe %q closed: %v", name, err)
 			return
 		}
-		in.output.Add(&Line{
-			T:        time.Now(),
-			Name:     name,
-			Data:     string(sl),
-			isPrefix: isPrefix,
-			instance: in,
-		})
+		if truncated > 0 {
+			sl, truncated = trimPartialRune(sl, truncated)
+		}
+		l := &Line{
+			T:         time.Now(),
+			Name:      name,
+			Data:      cleanLine(sl),
+			Truncated: truncated,
+			instance:  in,
+		}
+		if truncated == 0 {
+			l.Record = parseLine(in.logFormat, l.Data)
+		}
+		in.output.Add(l)
 	}
 	panic("unreachable")
 }
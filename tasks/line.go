@@ -1,15 +1,146 @@
 package tasks
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Line is a line of output from a TaskInstance.
 type Line struct {
 	T    time.Time
 	Name string // "stdout", "stderr", or "system"
-	Data string // line or prefix of line
+	Data string // the line, without its newline; see cleanLine
+	Seq  int64  // number of the line in its task's output, from 1; see WatchOutput
+
+	// Record is Data parsed, if the task has a structured
+	// logFormat and Data is in it, or nil.
+	Record *Record
+
+	// Truncated is how many bytes were dropped from the end of
+	// the line because it was longer than its task's
+	// maxLineLength, or 0.
+	Truncated int
 
-	isPrefix bool // truncated line? (too long)
 	instance *TaskInstance
 }
+
+// Pid returns the PID of the instance that output l, or 0 if unknown.
+func (l *Line) Pid() int {
+	if l.instance == nil {
+		return 0
+	}
+	return l.instance.Pid()
+}
+
+// Replica returns the index of the replica whose instance output l.
+func (l *Line) Replica() int {
+	if l.instance == nil {
+		return 0
+	}
+	return l.instance.replica.index
+}
+
+// TruncationNote returns a note of how much of the line was dropped
+// for being too long, such as "[truncated 1234 bytes]", or empty.
+func (l *Line) TruncationNote() string {
+	if l.Truncated == 0 {
+		return ""
+	}
+	return fmt.Sprintf("[truncated %d bytes]", l.Truncated)
+}
+
+// readLine reads a line from br, of any length, returning up to max
+// bytes of it and how many more bytes it had. The returned slice is
+// only valid until br's next read.
+func readLine(br *bufio.Reader, max int) (line []byte, truncated int, err error) {
+	var buf []byte
+	for {
+		frag, isPrefix, err := br.ReadLine()
+		if err != nil {
+			if len(buf) > 0 {
+				// A final line without a newline, ending at
+				// the end of br's buffer; the error will
+				// come again on the next read.
+				return buf, truncated, nil
+			}
+			return nil, 0, err
+		}
+		if buf == nil && !isPrefix {
+			// The common case: the whole line fit in br's buffer.
+			if len(frag) > max {
+				return frag[:max], len(frag) - max, nil
+			}
+			return frag, 0, nil
+		}
+		if room := max - len(buf); len(frag) > room {
+			buf = append(buf, frag[:room]...)
+			truncated += len(frag) - room
+		} else {
+			buf = append(buf, frag...)
+		}
+		if !isPrefix {
+			return buf, truncated, nil
+		}
+	}
+}
+
+// trimPartialRune moves a UTF-8 sequence cut short at the end of
+// line, where readLine truncated it, into truncated.
+func trimPartialRune(line []byte, truncated int) ([]byte, int) {
+	for i := len(line) - 1; i >= 0 && i >= len(line)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(line[i]) {
+			if !utf8.FullRune(line[i:]) {
+				truncated += len(line) - i
+				line = line[:i]
+			}
+			break
+		}
+	}
+	return line, truncated
+}
+
+// cleanLine returns b as a string that's safe to show and log: bytes
+// of invalid UTF-8 are escaped as \xNN, and control characters other
+// than tab, and those that reorder or break text, as \xNN or \uNNNN.
+func cleanLine(b []byte) string {
+	clean := true
+	for _, c := range b {
+		if c < 0x20 && c != '\t' || c >= 0x7f {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return string(b)
+	}
+	var buf bytes.Buffer
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&buf, `\x%02x`, b[0])
+		case r == '\t':
+			buf.WriteByte('\t')
+		case r < 0x80 && unicode.IsControl(r):
+			fmt.Fprintf(&buf, `\x%02x`, r)
+		case unicode.IsControl(r) || unicodeBreaksText(r):
+			fmt.Fprintf(&buf, `\u%04x`, r)
+		default:
+			buf.Write(b[:size])
+		}
+		b = b[size:]
+	}
+	return buf.String()
+}
+
+// unicodeBreaksText reports whether r is a line or paragraph
+// separator or a bidirectional control, which could make a line of
+// output appear as something else.
+func unicodeBreaksText(r rune) bool {
+	return r == 0x2028 || r == 0x2029 || r == 0x061c || r == 0x200e || r == 0x200f ||
+		(r >= 0x202a && r <= 0x202e) || (r >= 0x2066 && r <= 0x2069)
+}
@@ -0,0 +1,168 @@
+package tasks
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+// readLines reads all the lines from br as watchPipe does, returning
+// them and their truncated byte counts.
+func readLines(t *testing.T, br *bufio.Reader, max int) ([]string, []int) {
+	var lines []string
+	var truncs []int
+	for {
+		line, truncated, err := readLine(br, max)
+		if err == io.EOF {
+			return lines, truncs
+		}
+		if err != nil {
+			t.Fatalf("readLine: %v", err)
+		}
+		if truncated > 0 {
+			line, truncated = trimPartialRune(line, truncated)
+		}
+		lines = append(lines, string(line))
+		truncs = append(truncs, truncated)
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	long := strings.Repeat("x", 10000) // longer than bufio's default buffer
+	tests := []struct {
+		name    string
+		in      string
+		bufSize int // of the bufio.Reader, or 0 for the default
+		max     int
+		lines   []string
+		truncs  []int
+	}{
+		{
+			name:   "short lines",
+			in:     "one\ntwo\r\nthree\n",
+			max:    100,
+			lines:  []string{"one", "two", "three"},
+			truncs: []int{0, 0, 0},
+		},
+		{
+			name:   "longer than default buffer",
+			in:     long + "\nafter\n",
+			max:    64 << 10,
+			lines:  []string{long, "after"},
+			truncs: []int{0, 0},
+		},
+		{
+			name:    "reassembled from many fragments",
+			in:      strings.Repeat("abcdefgh", 20) + "\n",
+			bufSize: 16,
+			max:     1000,
+			lines:   []string{strings.Repeat("abcdefgh", 20)},
+			truncs:  []int{0},
+		},
+		{
+			name:   "truncated in one fragment",
+			in:     "0123456789\nok\n",
+			max:    4,
+			lines:  []string{"0123", "ok"},
+			truncs: []int{6, 0},
+		},
+		{
+			name:    "truncated across fragments",
+			in:      long + "\nok\n",
+			bufSize: 16,
+			max:     100,
+			lines:   []string{long[:100], "ok"},
+			truncs:  []int{9900, 0},
+		},
+		{
+			name:   "truncated mid-rune",
+			in:     "aaaaé\n", // é is 2 bytes; the cut falls between them
+			max:    5,
+			lines:  []string{"aaaa"},
+			truncs: []int{2},
+		},
+		{
+			name:    "truncated mid-rune across fragments",
+			in:      strings.Repeat("a", 15) + "日本語\n",
+			bufSize: 16,
+			max:     17,
+			lines:   []string{strings.Repeat("a", 15)},
+			truncs:  []int{9},
+		},
+		{
+			name:   "truncated at rune end",
+			in:     "aaaé!\n",
+			max:    5,
+			lines:  []string{"aaaé"},
+			truncs: []int{1},
+		},
+		{
+			name:   "no final newline",
+			in:     "one\ntwo",
+			max:    100,
+			lines:  []string{"one", "two"},
+			truncs: []int{0, 0},
+		},
+		{
+			name:    "long final line without newline",
+			in:      long,
+			bufSize: 16,
+			max:     64 << 10,
+			lines:   []string{long},
+			truncs:  []int{0},
+		},
+	}
+	for _, tt := range tests {
+		var br *bufio.Reader
+		if tt.bufSize > 0 {
+			br = bufio.NewReaderSize(strings.NewReader(tt.in), tt.bufSize)
+		} else {
+			br = bufio.NewReader(strings.NewReader(tt.in))
+		}
+		lines, truncs := readLines(t, br, tt.max)
+		if len(lines) != len(tt.lines) {
+			t.Errorf("%s: got %d lines; want %d", tt.name, len(lines), len(tt.lines))
+			continue
+		}
+		for i := range lines {
+			if lines[i] != tt.lines[i] || truncs[i] != tt.truncs[i] {
+				t.Errorf("%s: line %d = %.20q (%d bytes), truncated %d; want %.20q (%d bytes), truncated %d",
+					tt.name, i, lines[i], len(lines[i]), truncs[i], tt.lines[i], len(tt.lines[i]), tt.truncs[i])
+			}
+		}
+	}
+}
+
+func TestTruncationNote(t *testing.T) {
+	if got := (&Line{Data: "x"}).TruncationNote(); got != "" {
+		t.Errorf("untruncated line note = %q; want empty", got)
+	}
+	if got, want := (&Line{Data: "x", Truncated: 1234}).TruncationNote(), "[truncated 1234 bytes]"; got != want {
+		t.Errorf("truncated line note = %q; want %q", got, want)
+	}
+}
+
+func TestCleanLine(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain text", "plain text"},
+		{"tab\tstays", "tab\tstays"},
+		{`back\slash`, `back\slash`},
+		{"héllo, 世界", "héllo, 世界"},
+		{"\x1b[31mred\x1b[0m", `\x1b[31mred\x1b[0m`},
+		{"nul\x00 bell\x07 del\x7f", `nul\x00 bell\x07 del\x7f`},
+		{"cr\rlf\n", `cr\x0dlf\x0a`},
+		{"bad \xff byte", `bad \xff byte`},
+		{"cut \xe6\x97", `cut \xe6\x97`},
+		{"c1 \u0085 next", `c1 \u0085 next`},
+		{"rlo \u202e olleh", `rlo \u202e olleh`},
+		{"ls \u2028 ps \u2029", `ls \u2028 ps \u2029`},
+	}
+	for _, tt := range tests {
+		if got := cleanLine([]byte(tt.in)); got != tt.want {
+			t.Errorf("cleanLine(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,482 @@
+package tasks
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/runsit/jsonconfig"
+	. "github.com/bradfitz/runsit/logger"
+)
+
+// LogDir is the directory under which tasks' output is logged to
+// disk, in a directory per task, unless a task's "log" config block
+// says otherwise. If empty, only tasks with a "log" config block are
+// logged to disk.
+var LogDir string
+
+// logTimeFormat is the format of log file names' creation times,
+// which sort in time order.
+const logTimeFormat = "20060102T150405.000000Z"
+
+// logConfig is a task's parsed "log" config block.
+type logConfig struct {
+	dir        string        // directory of the log files
+	rotateSize int64         // rotate once the current file is this big, or 0
+	rotateAge  time.Duration // rotate once the current file is this old, or 0
+	compress   bool          // whether to gzip rotated files
+	keepFiles  int           // rotated files to keep, or 0 for all
+	keepAge    time.Duration // delete rotated files older than this, or 0
+}
+
+// parseLogConfig parses task's "log" config block, returning nil if
+// the task's output isn't logged to disk. has is whether the task
+// has a "log" block at all.
+func parseLogConfig(jc jsonconfig.Obj, has bool, task string) (*logConfig, error) {
+	if !has && LogDir == "" {
+		return nil, nil
+	}
+	lc := &logConfig{
+		dir:       jc.OptionalString("dir", ""),
+		rotateAge: jc.OptionalDuration("rotateAge", 0),
+		compress:  jc.OptionalBool("compress", false),
+		keepFiles: jc.OptionalInt("keepFiles", 10),
+		keepAge:   jc.OptionalDuration("keepAge", 0),
+	}
+	rotateSize := jc.OptionalString("rotateSize", "10M")
+	disabled := jc.OptionalBool("disabled", false)
+	if err := jc.Validate(); err != nil {
+		return nil, err
+	}
+	if disabled {
+		return nil, nil
+	}
+	if lc.dir == "" {
+		if LogDir == "" {
+			return nil, errors.New("no dir, and runsit has no -log_dir")
+		}
+		lc.dir = filepath.Join(LogDir, task)
+	}
+	if !filepath.IsAbs(lc.dir) {
+		return nil, fmt.Errorf("dir %q isn't absolute", lc.dir)
+	}
+	if rotateSize != "0" {
+		s, err := parseMemorySize(rotateSize)
+		if err != nil || s == "max" {
+			return nil, fmt.Errorf("rotateSize: invalid size %q", rotateSize)
+		}
+		lc.rotateSize, _ = strconv.ParseInt(s, 10, 64)
+	}
+	if lc.rotateAge < 0 || lc.keepFiles < 0 || lc.keepAge < 0 {
+		return nil, errors.New("rotateAge, keepFiles and keepAge must not be negative")
+	}
+	return lc, nil
+}
+
+// taskLog appends a task's output lines to its log files. Safe for
+// concurrent use.
+//
+// Each file is named for the task and the time it was created, such
+// as "web-20120106T154211.000000Z.log", so the newest is the current
+// one and the names of rotated files don't change (other than gaining
+// ".gz" when compressed). Each line of a file is a record of the form
+// "time\tstream\tinstance ID\tdata"; see formatLogLine.
+type taskLog struct {
+	task string // immutable
+
+	mu      sync.Mutex
+	conf    *logConfig // or nil, if not logging to disk
+	f       *os.File   // current file, or nil if not open yet
+	name    string     // of f
+	size    int64      // of f
+	created time.Time  // of f
+	lastErr string     // last error logged, to not repeat it for every line
+
+	rotateMu sync.Mutex // held while compressing and pruning rotated files, and reading them
+}
+
+// setConfig changes where and how the task is logged. A nil lc stops
+// logging to disk.
+func (tl *taskLog) setConfig(lc *logConfig) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if tl.conf != nil && lc != nil && tl.conf.dir == lc.dir {
+		tl.conf = lc
+		return
+	}
+	tl.closeFile()
+	tl.conf = lc
+}
+
+// Dir returns the directory the task's output is logged to, or empty
+// if it isn't logged to disk.
+func (tl *taskLog) Dir() string {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if tl.conf == nil {
+		return ""
+	}
+	return tl.conf.dir
+}
+
+func (tl *taskLog) closeFile() {
+	if tl.f != nil {
+		tl.f.Close()
+		tl.f = nil
+	}
+}
+
+// write appends l to the current log file, rotating it first if it's
+// due.
+func (tl *taskLog) write(l *Line) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if tl.conf == nil {
+		return
+	}
+	rec := formatLogLine(l)
+	if tl.f != nil && tl.dueForRotation(int64(len(rec))) {
+		tl.closeFile()
+		if tl.create() == nil {
+			go tl.cleanUp(tl.conf)
+		}
+	}
+	if tl.f == nil && tl.open() != nil {
+		return
+	}
+	n, err := tl.f.WriteString(rec)
+	tl.size += int64(n)
+	if err != nil {
+		tl.logError(err)
+	}
+}
+
+func (tl *taskLog) dueForRotation(n int64) bool {
+	lc := tl.conf
+	return (lc.rotateSize > 0 && tl.size > 0 && tl.size+n > lc.rotateSize) ||
+		(lc.rotateAge > 0 && time.Since(tl.created) > lc.rotateAge)
+}
+
+// open opens the newest log file to append to, or creates one.
+func (tl *taskLog) open() error {
+	if err := os.MkdirAll(tl.conf.dir, 0755); err != nil {
+		tl.logError(err)
+		return err
+	}
+	files, err := tl.files(tl.conf.dir)
+	if err != nil {
+		tl.logError(err)
+		return err
+	}
+	if n := len(files); n > 0 && !strings.HasSuffix(files[n-1].name, ".gz") {
+		lf := files[n-1]
+		f, err := os.OpenFile(filepath.Join(tl.conf.dir, lf.name), os.O_WRONLY|os.O_APPEND, 0644)
+		if err == nil {
+			fi, err := f.Stat()
+			if err == nil {
+				tl.f, tl.name, tl.size, tl.created = f, lf.name, fi.Size(), lf.created
+				return nil
+			}
+			f.Close()
+		}
+	}
+	return tl.create()
+}
+
+// create creates a new current log file.
+func (tl *taskLog) create() error {
+	now := time.Now().UTC()
+	name := tl.task + "-" + now.Format(logTimeFormat) + ".log"
+	f, err := os.OpenFile(filepath.Join(tl.conf.dir, name), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		tl.logError(err)
+		return err
+	}
+	tl.f, tl.name, tl.size, tl.created = f, name, 0, now
+	return nil
+}
+
+// logError logs err to runsit's log, rather than the task's output,
+// which would only lead back here.
+func (tl *taskLog) logError(err error) {
+	if s := err.Error(); s != tl.lastErr {
+		tl.lastErr = s
+		Logger.Printf("Task %q: error writing log file: %v", tl.task, err)
+	}
+}
+
+// cleanUp compresses and prunes the rotated log files in lc.dir: all
+// but the newest, which is current.
+// run in its own goroutine
+func (tl *taskLog) cleanUp(lc *logConfig) {
+	tl.rotateMu.Lock()
+	defer tl.rotateMu.Unlock()
+	files, err := tl.files(lc.dir)
+	if err != nil || len(files) == 0 {
+		return
+	}
+	rotated := files[:len(files)-1]
+	for i, lf := range rotated {
+		tooMany := lc.keepFiles > 0 && len(rotated)-i > lc.keepFiles
+		// Last written when the file after it was created.
+		tooOld := lc.keepAge > 0 && time.Since(files[i+1].created) > lc.keepAge
+		path := filepath.Join(lc.dir, lf.name)
+		switch {
+		case tooMany || tooOld:
+			os.Remove(path)
+		case lc.compress && !strings.HasSuffix(lf.name, ".gz"):
+			if err := gzipFile(path); err != nil {
+				Logger.Printf("Task %q: error compressing log file: %v", tl.task, err)
+			}
+		}
+	}
+}
+
+// gzipFile replaces path with a gzipped path+".gz".
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(path + ".gz.tmp")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+".gz.tmp", path+".gz")
+	}
+	if err != nil {
+		os.Remove(path + ".gz.tmp")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// logFile is one of a task's log files.
+type logFile struct {
+	name    string // base name
+	created time.Time
+}
+
+// files returns the task's log files in dir, oldest first.
+func (tl *taskLog) files(dir string) ([]logFile, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return nil, err
+	}
+	have := make(map[string]bool)
+	for _, name := range names {
+		have[name] = true
+	}
+	var files []logFile
+	for _, name := range names {
+		ts := strings.TrimPrefix(name, tl.task+"-")
+		if ts == name {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(ts, ".log"):
+			ts = strings.TrimSuffix(ts, ".log")
+		case strings.HasSuffix(ts, ".log.gz"):
+			if have[strings.TrimSuffix(name, ".gz")] {
+				// Compressing it was interrupted; the .log is
+				// complete, and cleanUp compresses it again.
+				continue
+			}
+			ts = strings.TrimSuffix(ts, ".log.gz")
+		default:
+			continue
+		}
+		created, err := time.Parse(logTimeFormat, ts)
+		if err != nil {
+			continue // some other task's, or not a log file
+		}
+		files = append(files, logFile{name, created})
+	}
+	sort.Sort(byLogCreated(files))
+	return files, nil
+}
+
+type byLogCreated []logFile
+
+func (s byLogCreated) Len() int           { return len(s) }
+func (s byLogCreated) Less(i, j int) bool { return s[i].created.Before(s[j].created) }
+func (s byLogCreated) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+var (
+	logEscaper   = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\t", `\t`)
+	logUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\t`, "\t")
+)
+
+// formatLogLine formats l as a log file record.
+// Lines that were truncated have a fifth field, how many bytes were
+// dropped.
+func formatLogLine(l *Line) string {
+	id := ""
+	if l.instance != nil {
+		id = l.instance.ID()
+	}
+	trunc := ""
+	if l.Truncated > 0 {
+		trunc = "\t" + strconv.Itoa(l.Truncated)
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%s%s\n", l.T.UTC().Format(time.RFC3339Nano), l.Name,
+		logEscaper.Replace(id), logEscaper.Replace(l.Data), trunc)
+}
+
+// LogLine is a line read back from a task's log files.
+type LogLine struct {
+	Line
+	Instance string // ID of the instance that output it
+}
+
+// parseLogLine parses a log file record, without its newline.
+func parseLogLine(rec string) (*LogLine, error) {
+	f := strings.Split(rec, "\t")
+	if len(f) != 4 && len(f) != 5 {
+		return nil, errors.New("malformed log record")
+	}
+	t, err := time.Parse(time.RFC3339Nano, f[0])
+	if err != nil {
+		return nil, err
+	}
+	ll := &LogLine{
+		Line:     Line{T: t, Name: f[1], Data: logUnescaper.Replace(f[3])},
+		Instance: logUnescaper.Replace(f[2]),
+	}
+	if len(f) == 5 {
+		if ll.Truncated, err = strconv.Atoi(f[4]); err != nil {
+			return nil, errors.New("malformed log record")
+		}
+	}
+	return ll, nil
+}
+
+// readLogFile returns the lines of the log file at path, which may be
+// gzipped.
+func readLogFile(path string) ([]*LogLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	var lines []*LogLine
+	br := bufio.NewReader(r)
+	for {
+		rec, err := br.ReadString('\n')
+		if err == io.EOF {
+			// A partial last record is still being written.
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+		if l, err := parseLogLine(strings.TrimSuffix(rec, "\n")); err == nil {
+			lines = append(lines, l)
+		}
+	}
+}
+
+// LogPage is a page of a task's on-disk log history.
+type LogPage struct {
+	Dir   string     // directory of the log files
+	Lines []*LogLine // oldest first
+	Older string     // position of the page before, or empty if at the start
+}
+
+// LogDir returns the directory the task's output is logged to, or
+// empty if it isn't logged to disk.
+func (t *Task) LogDir() string {
+	return t.log.Dir()
+}
+
+// LogHistory returns up to n lines of the task's on-disk log history
+// ending at pos, a position from a previous page's Older, or at the
+// end of the log if pos is empty.
+func (t *Task) LogHistory(pos string, n int) (*LogPage, error) {
+	dir := t.log.Dir()
+	if dir == "" {
+		return nil, errors.New("task isn't logged to disk")
+	}
+	// Keep cleanUp from compressing or pruning files between
+	// listing and reading them.
+	t.log.rotateMu.Lock()
+	defer t.log.rotateMu.Unlock()
+	files, err := t.log.files(dir)
+	if err != nil {
+		return nil, err
+	}
+	fi, end := len(files)-1, -1
+	if pos != "" {
+		i := strings.LastIndex(pos, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid log position %q", pos)
+		}
+		if end, err = strconv.Atoi(pos[i+1:]); err != nil {
+			return nil, fmt.Errorf("invalid log position %q", pos)
+		}
+		for fi = len(files) - 1; fi >= 0; fi-- {
+			if strings.TrimSuffix(files[fi].name, ".gz") == pos[:i] {
+				break
+			}
+		}
+		if fi < 0 {
+			return nil, fmt.Errorf("log file %s no longer exists", pos[:i])
+		}
+	}
+	page := &LogPage{Dir: dir}
+	for ; fi >= 0 && len(page.Lines) < n; fi, end = fi-1, -1 {
+		lines, err := readLogFile(filepath.Join(dir, files[fi].name))
+		if err != nil {
+			return nil, err
+		}
+		if end < 0 || end > len(lines) {
+			end = len(lines)
+		}
+		start := end - (n - len(page.Lines))
+		if start < 0 {
+			start = 0
+		}
+		page.Lines = append(lines[start:end:end], page.Lines...)
+		if start > 0 {
+			page.Older = fmt.Sprintf("%s:%d", strings.TrimSuffix(files[fi].name, ".gz"), start)
+			return page, nil
+		}
+	}
+	if fi >= 0 {
+		page.Older = fmt.Sprintf("%s:%d", strings.TrimSuffix(files[fi].name, ".gz"), -1)
+	}
+	return page, nil
+}
@@ -0,0 +1,413 @@
+package tasks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Log formats, for a task's "logFormat" config key: how its stdout
+// and stderr lines are parsed into Records.
+const (
+	formatText   = "text"   // not parsed
+	formatJSON   = "json"   // one JSON object per line
+	formatLogfmt = "logfmt" // key=value pairs, such as `level=info msg="hi there"`
+)
+
+func checkLogFormat(format string) error {
+	switch format {
+	case formatText, formatJSON, formatLogfmt:
+		return nil
+	}
+	return fmt.Errorf("unknown logFormat %q; want %q, %q or %q", format, formatText, formatJSON, formatLogfmt)
+}
+
+// parseMaxLineLength parses a task's "maxLineLength" config value,
+// a size like "64K": how much of each output line to keep before
+// truncating it.
+func parseMaxLineLength(v string) (int, error) {
+	s, err := parseMemorySize(v)
+	if err != nil || s == "max" {
+		return 0, fmt.Errorf("maxLineLength: invalid size %q", v)
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > 64<<20 {
+		return 0, fmt.Errorf("maxLineLength: %q isn't between 1 byte and 64M", v)
+	}
+	return n, nil
+}
+
+// Level is the severity of a structured log line.
+type Level int
+
+const (
+	LevelNone Level = iota // no level given, or an unknown one
+	LevelTrace
+	LevelDebug
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelFatal
+)
+
+var levelNames = []string{"", "trace", "debug", "info", "warn", "error", "fatal"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return ""
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name, such as "WARNING" or "err", or a
+// numeric level as used by bunyan and pino, such as 30 for info.
+func ParseLevel(s string) (Level, bool) {
+	switch strings.ToLower(s) {
+	case "trace", "trc":
+		return LevelTrace, true
+	case "debug", "dbg":
+		return LevelDebug, true
+	case "info", "inf", "information", "notice":
+		return LevelInfo, true
+	case "warn", "wrn", "warning":
+		return LevelWarn, true
+	case "error", "err", "eror":
+		return LevelError, true
+	case "fatal", "ftl", "panic", "crit", "critical", "alert", "emerg", "emergency":
+		return LevelFatal, true
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 10 {
+		l := Level(n/10) + LevelTrace - 1
+		if l > LevelFatal {
+			l = LevelFatal
+		}
+		return l, true
+	}
+	return LevelNone, false
+}
+
+// Record is the parsed form of a structured log line.
+type Record struct {
+	Level   Level
+	Message string
+	Time    time.Time // time the line says it was logged at, or zero
+	Fields  []Field   // the other keys
+}
+
+// Field is a key and value of a structured log line. Values that
+// aren't strings are in JSON.
+type Field struct {
+	Key, Value string
+}
+
+// Field returns the value of the line's field key, and whether it
+// had one. The keys "level", "msg" and "time" are those of the
+// Record's own fields, whatever the line called them.
+func (r *Record) Field(key string) (string, bool) {
+	switch key {
+	case "level":
+		return r.Level.String(), r.Level != LevelNone
+	case "msg":
+		return r.Message, true
+	case "time":
+		return r.Time.Format(time.RFC3339Nano), !r.Time.IsZero()
+	}
+	for _, f := range r.Fields {
+		if f.Key == key {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+// set sets the record's field from key and value, as parsed from a
+// line, recognizing the common names for its level, message and
+// time.
+func (r *Record) set(key, value string) {
+	// Unquoting may have brought back what cleanLine escaped.
+	key, value = cleanLine([]byte(key)), cleanLine([]byte(value))
+	switch strings.ToLower(key) {
+	case "level", "lvl", "severity", "levelname", "loglevel":
+		if l, ok := ParseLevel(value); ok && r.Level == LevelNone {
+			r.Level = l
+			return
+		}
+	case "msg", "message":
+		if r.Message == "" {
+			r.Message = value
+			return
+		}
+	case "time", "ts", "timestamp", "@timestamp":
+		if t, ok := parseRecordTime(value); ok && r.Time.IsZero() {
+			r.Time = t
+			return
+		}
+	}
+	r.Fields = append(r.Fields, Field{key, value})
+}
+
+// parseRecordTime parses an RFC 3339 time, or a Unix time in seconds
+// or milliseconds.
+func parseRecordTime(v string) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, true
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f <= 0 {
+		return time.Time{}, false
+	}
+	if f > 1e12 {
+		f /= 1000 // milliseconds
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), true
+}
+
+// parseLine parses data, a line of output, in format, returning nil
+// if it's not in that format.
+func parseLine(format, data string) *Record {
+	switch format {
+	case formatJSON:
+		return parseJSONLine(data)
+	case formatLogfmt:
+		return parseLogfmtLine(data)
+	}
+	return nil
+}
+
+func parseJSONLine(data string) *Record {
+	data = strings.TrimSpace(data)
+	if !strings.HasPrefix(data, "{") {
+		return nil
+	}
+	d := json.NewDecoder(strings.NewReader(data))
+	d.UseNumber()
+	var m map[string]interface{}
+	if err := d.Decode(&m); err != nil {
+		return nil
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	r := new(Record)
+	for _, k := range keys {
+		switch v := m[k].(type) {
+		case string:
+			r.set(k, v)
+		case json.Number:
+			r.set(k, v.String())
+		default:
+			var buf bytes.Buffer
+			e := json.NewEncoder(&buf)
+			e.SetEscapeHTML(false)
+			e.Encode(v)
+			r.set(k, strings.TrimSuffix(buf.String(), "\n"))
+		}
+	}
+	return r
+}
+
+// parseLogfmtLine parses a logfmt line: space-separated key=value
+// pairs, with values optionally double-quoted, and keys without a
+// value meaning "true". A line without any key=value pair isn't
+// logfmt.
+func parseLogfmtLine(data string) *Record {
+	r := new(Record)
+	pairs := false
+	s := strings.TrimSpace(data)
+	for s != "" {
+		i := strings.IndexAny(s, "= ")
+		if i == 0 {
+			return nil
+		}
+		if i < 0 || s[i] == ' ' {
+			if i < 0 {
+				i = len(s)
+			}
+			key := s[:i]
+			if strings.Contains(key, `"`) {
+				return nil
+			}
+			r.set(key, "true")
+			s = strings.TrimLeft(s[i:], " ")
+			continue
+		}
+		key, value := s[:i], ""
+		if strings.Contains(key, `"`) {
+			return nil
+		}
+		s = s[i+1:]
+		if strings.HasPrefix(s, `"`) {
+			end := quotedEnd(s)
+			if end < 0 {
+				return nil
+			}
+			var err error
+			if value, err = strconv.Unquote(s[:end]); err != nil {
+				// Not a Go quoted string; take it literally.
+				value = s[1 : end-1]
+			}
+			s = s[end:]
+			if s != "" && s[0] != ' ' {
+				return nil
+			}
+		} else {
+			j := strings.IndexByte(s, ' ')
+			if j < 0 {
+				j = len(s)
+			}
+			value, s = s[:j], s[j:]
+		}
+		if !utf8.ValidString(value) {
+			return nil
+		}
+		r.set(key, value)
+		pairs = true
+		s = strings.TrimLeft(s, " ")
+	}
+	if !pairs {
+		return nil
+	}
+	return r
+}
+
+// quotedEnd returns the index after the closing quote of the quoted
+// string s starts with, or -1 if it's unterminated.
+func quotedEnd(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// FieldFilter is a condition on the parsed fields of structured
+// output lines, such as "level>=warn", "user=bob" or "path~^/api/".
+// Lines that weren't parsed never match.
+type FieldFilter struct {
+	Key   string
+	Op    string // "=", "!=", "<", "<=", ">", ">=" or "~" (regexp match)
+	Value string
+
+	re *regexp.Regexp // for "~"
+}
+
+// filterOps are the operators of FieldFilters, longest first, so
+// that "<=" is found before "<".
+var filterOps = []string{"!=", "<=", ">=", "=", "<", ">", "~"}
+
+// ParseFieldFilter parses a FieldFilter from its string form,
+// key followed by operator followed by value.
+func ParseFieldFilter(s string) (*FieldFilter, error) {
+	i := strings.IndexAny(s, "!=<>~")
+	if i <= 0 {
+		return nil, fmt.Errorf("bad filter %q; want key, operator and value, such as level>=warn", s)
+	}
+	f := &FieldFilter{Key: strings.TrimSpace(s[:i])}
+	for _, op := range filterOps {
+		if strings.HasPrefix(s[i:], op) {
+			f.Op = op
+			f.Value = strings.TrimSpace(s[i+len(op):])
+			break
+		}
+	}
+	switch {
+	case f.Op == "":
+		return nil, fmt.Errorf("bad operator in filter %q", s)
+	case f.Op == "~":
+		re, err := regexp.Compile(f.Value)
+		if err != nil {
+			return nil, fmt.Errorf("filter %q: %v", s, err)
+		}
+		f.re = re
+	case f.Key == "level":
+		if _, ok := ParseLevel(f.Value); !ok {
+			return nil, fmt.Errorf("filter %q: unknown level %q", s, f.Value)
+		}
+	}
+	return f, nil
+}
+
+func (f *FieldFilter) String() string {
+	return f.Key + f.Op + f.Value
+}
+
+// Match reports whether l is a structured line matching f.
+func (f *FieldFilter) Match(l *Line) bool {
+	if l.Record == nil {
+		return false
+	}
+	v, ok := l.Record.Field(f.Key)
+	if f.Op == "!=" && !ok {
+		return true
+	}
+	if !ok {
+		return false
+	}
+	if f.re != nil {
+		return f.re.MatchString(v)
+	}
+	var cmp int
+	if f.Key == "level" {
+		want, _ := ParseLevel(f.Value)
+		cmp = int(l.Record.Level) - int(want)
+	} else if a, b, ok := parseFloats(v, f.Value); ok {
+		switch {
+		case a < b:
+			cmp = -1
+		case a > b:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(v, f.Value)
+	}
+	switch f.Op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func parseFloats(a, b string) (float64, float64, bool) {
+	x, err := strconv.ParseFloat(a, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	y, err := strconv.ParseFloat(b, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return x, y, true
+}
+
+// MatchFilters reports whether l matches all of filters.
+func MatchFilters(l *Line, filters []*FieldFilter) bool {
+	for _, f := range filters {
+		if !f.Match(l) {
+			return false
+		}
+	}
+	return true
+}
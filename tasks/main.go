@@ -0,0 +1,53 @@
+package tasks
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// MainTask is the name of the task whose exit ends runsit, when it
+// runs as a container's init process, or empty.
+var MainTask string
+
+// MainExit receives MainTask's exit status once it has exited and
+// won't be restarted.
+var MainExit = make(chan int, 1)
+
+// checkMainExit sends in's exit status on MainExit if in's task is
+// MainTask and none of its replicas will run again.
+// run in Task.loop
+func (t *Task) checkMainExit(in *TaskInstance) {
+	if t.Name != MainTask {
+		return
+	}
+	for _, r := range t.replicas {
+		if r.state != StateExited && r.state != StateFatal && r.state != StateCompleted {
+			return
+		}
+	}
+	select {
+	case MainExit <- exitStatus(in.waitErr):
+	default:
+	}
+}
+
+// exitStatus returns the shell-style exit status for err, as returned
+// by exec.Cmd.Wait: the exit code, or 128 plus the number of the
+// signal that killed the process.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	ee, ok := err.(*exec.ExitError)
+	if !ok {
+		return 1
+	}
+	ws, ok := ee.Sys().(syscall.WaitStatus)
+	if !ok {
+		return 1
+	}
+	if ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ws.ExitStatus()
+}
@@ -8,7 +8,22 @@ type stopMessage struct {
 	resc chan error
 }
 
-type restartIfStoppedMessage struct{}
+// killMessage asks that the running instance with the given pid be
+// stopped and then restarted.
+type killMessage struct {
+	pid  int
+	resc chan error
+}
+
+// startMessage asks that a stopped or exited task be started again.
+type startMessage struct{}
+
+// restartIfStoppedMessage is sent by the timer started in
+// replica.retryIn. Messages with a stale gen are ignored.
+type restartIfStoppedMessage struct {
+	r   *replica
+	gen int
+}
 
 // instanceGoneMessage is sent when a task instance's process finishes,
 // successfully or otherwise. Any error is in instance.waitErr.
@@ -21,3 +36,32 @@ type instanceGoneMessage struct {
 type statusRequestMessage struct {
 	resCh chan<- *TaskStatus
 }
+
+// readyMessage is sent by the timers started in awaitReady when in,
+// a replica's next instance, has been up long enough to be ready, or
+// (if timedOut) too long without becoming ready.
+type readyMessage struct {
+	in       *TaskInstance
+	timedOut bool
+}
+
+// notifyMessage is sent by an instance's watchNotify goroutine for
+// each message the instance sends on its notify fd.
+type notifyMessage struct {
+	in     *TaskInstance
+	fields map[string]string // such as "READY": "1"
+}
+
+// watchdogMessage is sent by the timer started in armWatchdog.
+// Messages with a stale gen are ignored.
+type watchdogMessage struct {
+	in  *TaskInstance
+	gen int
+}
+
+// healthResultMessage is sent by an instance's watchHealth goroutine
+// after each health check.
+type healthResultMessage struct {
+	in  *TaskInstance
+	err error // nil if healthy
+}
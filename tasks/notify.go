@@ -0,0 +1,104 @@
+package tasks
+
+import (
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// notifyPipe returns a connected pair of datagram sockets for an
+// instance to send sd_notify-style messages to runsit on. The child's
+// end is passed to the instance and announced as RUNSIT_NOTIFY_FD.
+func notifyPipe() (conn *net.UnixConn, child *os.File, err error) {
+	// Not SOCK_CLOEXEC, which not every OS has; hold ForkLock
+	// instead so no other fork inherits the fds.
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socketpair", err)
+	}
+	parent := os.NewFile(uintptr(fds[0]), "notify")
+	defer parent.Close()
+	c, err := net.FileConn(parent)
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, nil, err
+	}
+	return c.(*net.UnixConn), os.NewFile(uintptr(fds[1]), "notify child"), nil
+}
+
+// parseNotify parses a notify message: newline-separated KEY=VALUE
+// assignments. Lines without an '=' are ignored.
+func parseNotify(msg string) map[string]string {
+	m := make(map[string]string)
+	for _, line := range strings.Split(msg, "\n") {
+		if i := strings.Index(line, "="); i > 0 {
+			m[line[:i]] = line[i+1:]
+		}
+	}
+	return m
+}
+
+// watchNotify reads messages from the instance's notify socket until
+// the instance exits, passing them to Task.loop.
+// run in its own goroutine
+func (in *TaskInstance) watchNotify(conn *net.UnixConn) {
+	go func() {
+		<-in.done
+		conn.Close()
+	}()
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case in.task.controlc <- notifyMessage{in, parseNotify(string(buf[:n]))}:
+		case <-in.done:
+			return
+		}
+	}
+}
+
+// run in Task.loop
+func (t *Task) onNotify(m notifyMessage) {
+	in := m.in
+	r := in.replica
+	if in != r.running && in != r.next {
+		return
+	}
+	if m.fields["WATCHDOG"] == "1" {
+		t.armWatchdog(in)
+	}
+	if s, ok := m.fields["STATUS"]; ok {
+		in.childStatus = s
+	}
+	if m.fields["READY"] == "1" && !in.notifiedReady {
+		in.notifiedReady = true
+		in.Printf("notified ready")
+		t.onInstanceReady(in)
+	}
+}
+
+// onInstanceReady is called when in may have just become ready, by
+// notification or health check.
+// run in Task.loop
+func (t *Task) onInstanceReady(in *TaskInstance) {
+	if !in.ready() {
+		return
+	}
+	r := in.replica
+	switch {
+	case in == r.next:
+		t.promote(r)
+	case in == r.running && r.state == StateStarting:
+		r.setState(StateRunning, "PID %d ready", in.Pid())
+	}
+}
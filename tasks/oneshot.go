@@ -0,0 +1,44 @@
+package tasks
+
+import (
+	"fmt"
+
+	"github.com/bradfitz/runsit/jsonconfig"
+)
+
+// Task types, for a task's "type" config key.
+const (
+	typeDaemon  = "daemon"  // runs indefinitely
+	typeOneshot = "oneshot" // runs to completion once per config change
+)
+
+// parseSuccessExitCodes reads a task's "successExitCodes" key: the
+// exit codes that mean an instance exited successfully, rather than
+// failed. The default is just 0.
+func parseSuccessExitCodes(jc jsonconfig.Obj) ([]int, error) {
+	codes := jc.OptionalIntList("successExitCodes")
+	if codes == nil {
+		return []int{0}, nil
+	}
+	for _, c := range codes {
+		if c < 0 || c > 255 {
+			return nil, fmt.Errorf("successExitCodes: %d isn't an exit code", c)
+		}
+	}
+	return codes, nil
+}
+
+// succeeded reports whether the instance exited with one of its
+// success exit codes, and wasn't stopped by runsit as failed. Only
+// valid once the instance has finished.
+func (in *TaskInstance) succeeded() bool {
+	if in.failReason != "" || in.exit == nil || in.exit.Signal != 0 {
+		return false
+	}
+	for _, c := range in.successCodes {
+		if in.exit.Code == c {
+			return true
+		}
+	}
+	return false
+}
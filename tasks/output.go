@@ -7,12 +7,28 @@ import (
 
 // TaskOutput is the output of a TaskInstance.
 // Only the last maxKeepLines lines are kept.
+// Lines are also passed on to the task's LineWatchers, and written
+// to its log files, if it has any.
 type TaskOutput struct {
+	log *taskLog // set once; immutable
+	hub *lineHub // set once; immutable
+
 	mu    sync.Mutex
 	lines list.List // of *Line
 }
 
 func (to *TaskOutput) Add(l *Line) {
+	if to.log != nil {
+		to.log.write(l)
+	}
+	if to.hub != nil {
+		to.hub.publish(l, to.keep)
+	} else {
+		to.keep(l)
+	}
+}
+
+func (to *TaskOutput) keep(l *Line) {
 	to.mu.Lock()
 	defer to.mu.Unlock()
 	to.lines.PushBack(l)
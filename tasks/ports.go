@@ -0,0 +1,108 @@
+package tasks
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/bradfitz/runsit/jsonconfig"
+)
+
+// portSpec is a parsed entry of a task's "ports" config object. The
+// value of an entry is a port number, an "ip:port" string, or an
+// object with either a "port" number or an "addr" string, and an
+// optional boolean "perReplica".
+type portSpec struct {
+	name string
+	addr string // listen address, such as ":8000"
+
+	// perReplica is whether each replica gets its own listener, with
+	// replica i listening on addr's port plus i. Otherwise the
+	// replicas all share one listener.
+	//
+	// Either way, listeners are keyed by their listen address, so
+	// a listener is re-bound only when its address changes.
+	perReplica bool
+}
+
+func parsePorts(ports jsonconfig.Obj) ([]*portSpec, error) {
+	var specs []*portSpec
+	for name, vi := range ports {
+		if len(name) > 0 && name[0] == '_' {
+			continue // comment, or jsonconfig bookkeeping
+		}
+		ps := &portSpec{name: name}
+		if m, ok := vi.(map[string]interface{}); ok {
+			pc := jsonconfig.Obj(m)
+			port := pc.OptionalInt("port", 0)
+			addr := pc.OptionalString("addr", "")
+			ps.perReplica = pc.OptionalBool("perReplica", false)
+			if err := pc.Validate(); err != nil {
+				return nil, fmt.Errorf("port %q: %v", name, err)
+			}
+			if (port == 0) == (addr == "") {
+				return nil, fmt.Errorf("port %q: exactly one of \"port\" or \"addr\" required", name)
+			}
+			vi = addr
+			if port != 0 {
+				vi = float64(port)
+			}
+		}
+		switch v := vi.(type) {
+		case float64:
+			ps.addr = ":" + strconv.Itoa(int(v))
+		case string:
+			ps.addr = v
+		default:
+			return nil, fmt.Errorf("port %q value must be a string or integer", name)
+		}
+		if _, _, err := net.SplitHostPort(ps.addr); err != nil {
+			return nil, fmt.Errorf("port %q: %v", name, err)
+		}
+		specs = append(specs, ps)
+	}
+	// Map iteration order is random; keep fd numbers stable.
+	sort.Sort(byPortName(specs))
+	return specs, nil
+}
+
+type byPortName []*portSpec
+
+func (s byPortName) Len() int           { return len(s) }
+func (s byPortName) Less(i, j int) bool { return s[i].name < s[j].name }
+func (s byPortName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// replicaAddr returns the address replica i should listen on.
+func (ps *portSpec) replicaAddr(i int) (string, error) {
+	if !ps.perReplica || i == 0 {
+		return ps.addr, nil
+	}
+	host, port, _ := net.SplitHostPort(ps.addr)
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return "", fmt.Errorf("port %q: per-replica port %q must be numeric", ps.name, port)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(n+i)), nil
+}
+
+// listener is a listening socket opened by runsit for a task.
+type listener struct {
+	f    *os.File // passed to instances as an inherited fd
+	addr string   // dialable address of the listener
+}
+
+// listen listens on the TCP address addr.
+func listen(addr string) (*listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	lf, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		return nil, err
+	}
+	return &listener{f: lf, addr: dialAddr(ln.Addr().String())}, nil
+}
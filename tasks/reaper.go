@@ -0,0 +1,225 @@
+package tasks
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// descendantScanInterval is how often a running instance's
+	// process tree is scanned for new descendants.
+	descendantScanInterval = 1 * time.Second
+
+	// killVerifyTimeout is how long killDescendants waits for
+	// leftover processes to die after SIGKILL.
+	killVerifyTimeout = 5 * time.Second
+)
+
+// proc is a process in the process table.
+type proc struct {
+	pid, ppid, pgid int
+	state           byte   // such as 'R', 'S' or 'Z'
+	start           uint64 // start time; with pid, identifies the process
+	utime, stime    uint64 // CPU time, in clock ticks
+	comm            string
+}
+
+func (p *proc) String() string {
+	return fmt.Sprintf("%d (%s)", p.pid, p.comm)
+}
+
+// same reports whether p and q are the same process, and not just
+// processes that happened to get the same pid.
+func (p *proc) same(q *proc) bool {
+	return p.pid == q.pid && p.start == q.start
+}
+
+// waitedMu guards waited, the pids of runsit's children that an
+// exec.Cmd will wait for. It's held while such children are started
+// and while orphans are reaped, so ReapOrphans never reaps a child
+// out from under its exec.Cmd.
+var (
+	waitedMu sync.Mutex
+	waited   = make(map[int]bool)
+)
+
+// startCmd starts cmd. Once cmd has been waited for, the caller must
+// call cmdWaited.
+func startCmd(cmd *exec.Cmd) error {
+	waitedMu.Lock()
+	defer waitedMu.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	waited[cmd.Process.Pid] = true
+	return nil
+}
+
+// cmdWaited records that cmd, started with startCmd, was waited for.
+func cmdWaited(cmd *exec.Cmd) {
+	waitedMu.Lock()
+	defer waitedMu.Unlock()
+	delete(waited, cmd.Process.Pid)
+}
+
+// ReapOrphans reaps runsit's exited children that nothing else will
+// wait for: the descendants of tasks that were reparented to runsit,
+// as a subreaper, when their parents exited.
+func ReapOrphans() {
+	waitedMu.Lock()
+	defer waitedMu.Unlock()
+	procs, err := readProcs()
+	if err != nil {
+		return
+	}
+	self := os.Getpid()
+	for pid, p := range procs {
+		if p.ppid != self || p.state != 'Z' || waited[pid] {
+			continue
+		}
+		var ws syscall.WaitStatus
+		syscall.Wait4(pid, &ws, syscall.WNOHANG, nil)
+	}
+}
+
+// scanDescendants updates the instance's descendants from procs, the
+// current process table, and returns them. They're its process
+// group, its cgroup, the processes it previously found, and their
+// descendants in turn. Processes that leave the process group and
+// are orphaned between scans can be missed, unless the instance has
+// a cgroup.
+func (in *TaskInstance) scanDescendants(procs map[int]*proc) map[int]*proc {
+	pid := in.Pid()
+	children := make(map[int][]int)
+	var queue []int
+	for _, p := range procs {
+		children[p.ppid] = append(children[p.ppid], p.pid)
+		if p.pgid == pid && p.pid != pid {
+			queue = append(queue, p.pid)
+		}
+	}
+	queue = append(queue, children[pid]...)
+	if in.cgroup != "" {
+		for _, cpid := range cgroupProcs(in.cgroup) {
+			if cpid != pid {
+				queue = append(queue, cpid)
+			}
+		}
+	}
+
+	in.descMu.Lock()
+	defer in.descMu.Unlock()
+	for dpid, d := range in.descendants {
+		if p, ok := procs[dpid]; ok && p.same(d) {
+			queue = append(queue, dpid)
+		}
+	}
+	found := make(map[int]*proc)
+	for len(queue) > 0 {
+		dpid := queue[0]
+		queue = queue[1:]
+		p, ok := procs[dpid]
+		if !ok || found[dpid] != nil {
+			continue
+		}
+		found[dpid] = p
+		queue = append(queue, children[dpid]...)
+	}
+	in.descendants = found
+	return found
+}
+
+// trackDescendants periodically scans for the instance's descendants
+// until it exits, so they can still be found after they're orphaned.
+// run in its own goroutine
+func (in *TaskInstance) trackDescendants() {
+	for {
+		procs, err := readProcs()
+		if err != nil {
+			return
+		}
+		in.scanDescendants(procs)
+		select {
+		case <-time.After(descendantScanInterval):
+		case <-in.done:
+			return
+		}
+	}
+}
+
+// Descendants returns the instance's processes other than its own, as
+// of the last scan, such as "1234 (perl)".
+func (in *TaskInstance) Descendants() []string {
+	in.descMu.Lock()
+	defer in.descMu.Unlock()
+	return procList(in.descendants)
+}
+
+// killDescendants kills whatever remains of the instance's process
+// tree once its own process has exited, logging the stragglers, and
+// waits for them to die.
+func (in *TaskInstance) killDescendants() {
+	procs, err := readProcs()
+	if err != nil {
+		// No process table to search; the process group is the
+		// best we can do.
+		syscall.Kill(-in.Pid(), syscall.SIGKILL)
+		return
+	}
+	left := make(map[int]*proc)
+	for pid, p := range in.scanDescendants(procs) {
+		if p.state != 'Z' {
+			left[pid] = p
+		}
+	}
+	if len(left) == 0 {
+		ReapOrphans()
+		return
+	}
+	in.Printf("killing %d leftover processes: %s", len(left), strings.Join(procList(left), ", "))
+	for pid := range left {
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+	deadline := time.Now().Add(killVerifyTimeout)
+	for {
+		ReapOrphans()
+		procs, err = readProcs()
+		if err != nil {
+			return
+		}
+		for pid, p := range left {
+			if q, ok := procs[pid]; !ok || !q.same(p) || q.state == 'Z' {
+				delete(left, pid)
+			}
+		}
+		if len(left) == 0 {
+			in.Printf("leftover processes killed")
+			return
+		}
+		if time.Now().After(deadline) {
+			in.Printf("%d leftover processes still running %v after SIGKILL: %s", len(left), killVerifyTimeout, strings.Join(procList(left), ", "))
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// procList returns procs as strings, in pid order.
+func procList(procs map[int]*proc) []string {
+	var pids []int
+	for pid := range procs {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	var list []string
+	for _, pid := range pids {
+		list = append(list, procs[pid].String())
+	}
+	return list
+}
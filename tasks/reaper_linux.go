@@ -0,0 +1,73 @@
+package tasks
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const prSetChildSubreaper = 36
+
+// BecomeSubreaper makes runsit a child subreaper, so that tasks'
+// descendants are reparented to it, rather than to init, when their
+// parents exit.
+func BecomeSubreaper() error {
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// readProcs returns the process table, by pid.
+func readProcs() (map[int]*proc, error) {
+	d, err := os.Open("/proc")
+	if err != nil {
+		return nil, err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return nil, err
+	}
+	procs := make(map[int]*proc)
+	for _, name := range names {
+		pid, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+		if p, err := readProc(pid); err == nil {
+			procs[pid] = p
+		}
+	}
+	return procs, nil
+}
+
+// readProc reads process pid from /proc/pid/stat.
+func readProc(pid int) (*proc, error) {
+	stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return nil, err
+	}
+	// The command name is in parens, and may contain anything,
+	// including spaces and parens.
+	lp, rp := bytes.IndexByte(stat, '('), bytes.LastIndexByte(stat, ')')
+	if lp < 0 || rp < lp {
+		return nil, errors.New("malformed stat")
+	}
+	f := strings.Fields(string(stat[rp+1:]))
+	if len(f) < 20 {
+		return nil, errors.New("malformed stat")
+	}
+	p := &proc{pid: pid, state: f[0][0], comm: string(stat[lp+1 : rp])}
+	p.ppid, _ = strconv.Atoi(f[1])
+	p.pgid, _ = strconv.Atoi(f[2])
+	p.utime, _ = strconv.ParseUint(f[11], 10, 64)
+	p.stime, _ = strconv.ParseUint(f[12], 10, 64)
+	p.start, _ = strconv.ParseUint(f[19], 10, 64)
+	return p, nil
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package tasks
+
+import "errors"
+
+func BecomeSubreaper() error {
+	return errors.New("subreaper not supported on this OS")
+}
+
+func readProcs() (map[int]*proc, error) {
+	return nil, errors.New("process table not supported on this OS")
+}
@@ -0,0 +1,136 @@
+package tasks
+
+import (
+	"fmt"
+	"time"
+)
+
+// A replica is one of the "replicas" copies of a task. Each replica
+// runs its own series of TaskInstances, with its own failure history
+// and restart timer.
+type replica struct {
+	task  *Task // immutable
+	index int   // immutable; exported to instances as RUNSIT_REPLICA_INDEX
+
+	// Owned by Task.loop:
+	running   *TaskInstance
+	next      *TaskInstance     // during an overlap rollout, the instance replacing running
+	failures  []*TaskInstance   // last few failures, oldest first.
+	completed *TaskInstance     // last instance to exit successfully, or nil
+	state     TaskState         // current state; see setState
+	history   []StateTransition // last few state transitions, oldest first.
+	startErr  error             // error launching an instance from a valid config
+	errTime   time.Time         // of startErr
+
+	// Restart state, also owned by Task.loop:
+	backoff      time.Duration // last restart delay, before jitter; zero after a healthy run
+	recentFails  []time.Time   // end times of failed instances within restart.failureWindow
+	restartTimer *time.Timer   // pending restartIfStoppedMessage, or nil
+	restartAt    time.Time     // when restartTimer fires
+	restartGen   int           // incremented when restartTimer changes, to detect stale messages
+}
+
+func (r *replica) Printf(format string, args ...interface{}) {
+	if len(r.task.replicas) > 1 {
+		format = fmt.Sprintf("replica %d: %s", r.index, format)
+	}
+	r.task.Printf(format, args...)
+}
+
+// scheduleRestart arranges for the replica to be restarted in d,
+// unless it's running by then.
+// run in Task.loop
+func (r *replica) scheduleRestart(d time.Duration) {
+	r.setState(StateBackoff, "restarting in %v", d)
+	r.retryIn(d)
+}
+
+// retryIn arranges for restartIfStopped to be called for the replica
+// in d. Any previously scheduled restart is canceled.
+// run in Task.loop
+func (r *replica) retryIn(d time.Duration) {
+	r.cancelRestart()
+	gen := r.restartGen
+	r.restartAt = time.Now().Add(d)
+	r.restartTimer = time.AfterFunc(d, func() {
+		r.task.controlc <- restartIfStoppedMessage{r, gen}
+	})
+}
+
+// run in Task.loop
+func (r *replica) cancelRestart() {
+	if r.restartTimer != nil {
+		r.restartTimer.Stop()
+		r.restartTimer = nil
+	}
+	r.restartAt = time.Time{}
+	r.restartGen++
+}
+
+// addFailure adds in to the replica's recent failures, forgetting
+// the oldest beyond the last few.
+// run in Task.loop
+func (r *replica) addFailure(in *TaskInstance) {
+	const keepFailures = 5
+	if len(r.failures) == keepFailures {
+		copy(r.failures, r.failures[1:])
+		r.failures = r.failures[:keepFailures-1]
+	}
+	r.failures = append(r.failures, in)
+}
+
+// resetBackoff forgets the replica's recent failures.
+// run in Task.loop
+func (r *replica) resetBackoff() {
+	r.cancelRestart()
+	r.backoff = 0
+	r.recentFails = nil
+}
+
+// run in Task.loop
+func (r *replica) startError(format string, args ...interface{}) error {
+	r.startErr = fmt.Errorf(format, args...)
+	r.errTime = time.Now()
+	r.setState(StateStartError, "%v", r.startErr)
+	return r.startErr
+}
+
+// ready reports whether the replica's running instance, if any, is
+// ready, or its oneshot task has completed.
+// run in Task.loop
+func (r *replica) ready() bool {
+	return r.state == StateCompleted || r.running != nil && r.running.ready()
+}
+
+// setReplicas grows or shrinks t.replicas to n. Replicas being removed
+// must already be stopped.
+// run in Task.loop
+func (t *Task) setReplicas(n int) {
+	for len(t.replicas) > n {
+		r := t.replicas[len(t.replicas)-1]
+		r.cancelRestart()
+		t.replicas = t.replicas[:len(t.replicas)-1]
+	}
+	for len(t.replicas) < n {
+		r := &replica{task: t, index: len(t.replicas)}
+		if len(t.replicas) > 0 {
+			// Start out in the same state as its siblings.
+			r0 := t.replicas[0]
+			r.setState(r0.state, "new replica")
+		} else {
+			r.setState(StateStarting, "created")
+		}
+		t.replicas = append(t.replicas, r)
+	}
+}
+
+// replicaOf returns the replica with the given pid running, or nil.
+// run in Task.loop
+func (t *Task) replicaOf(pid int) *replica {
+	for _, r := range t.replicas {
+		if r.running != nil && r.running.Pid() == pid && pid != 0 {
+			return r
+		}
+	}
+	return nil
+}
@@ -15,17 +15,34 @@ import (
 // in the environment variable _RUNSIT_LAUNCH_INFO.  The child then
 // drops root and execs itself to be the requested process.
 type LaunchRequest struct {
-	Uid      int   // or 0 to not change
-	Gid      int   // or 0 to not change
-	Gids     []int // supplemental
-	Path     string
-	Env      []string
-	Argv     []string // must include Path as argv[0]
-	Dir      string
-	NumFiles int // new nfile fd rlimit, or 0 to not change
+	Uid     int   // or 0 to not change
+	Gid     int   // or 0 to not change
+	Gids    []int // supplemental
+	Path    string
+	Env     []string
+	Argv    []string // must include Path as argv[0]
+	Dir     string
+	Root    string   // directory to chroot to, or empty; Path and Dir are within it
+	Rlimits []Rlimit // set before dropping root
+	Cgroup  string   // cgroup v2 directory to join, or empty
+	Sandbox *Sandbox // or nil
+	Sched   *Sched   // or nil
+
+	// If LimitCapabilities, the process keeps exactly Capabilities
+	// (as ambient capabilities if it isn't root).
+	LimitCapabilities bool
+	Capabilities      []int
+	NoNewPrivileges   bool // sets PR_SET_NO_NEW_PRIVS
+
+	NumExtraFiles int // inherited fds after stderr; set by start
+
+	// HostPath is the binary's absolute path outside Root, as
+	// checked by runsit. Informational only.
+	HostPath string
 }
 
 func (lr *LaunchRequest) start(extraFiles []*os.File) (cmd *exec.Cmd, outPipe, errPipe io.ReadCloser, err error) {
+	lr.NumExtraFiles = len(extraFiles)
 	var buf bytes.Buffer
 	b64enc := base64.NewEncoder(base64.StdEncoding, &buf)
 	err = gob.NewEncoder(b64enc).Encode(lr)
@@ -50,6 +67,9 @@ func (lr *LaunchRequest) start(extraFiles []*os.File) (cmd *exec.Cmd, outPipe, e
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true,
 	}
+	if lr.Sandbox != nil {
+		lr.Sandbox.setSysProcAttr(cmd.SysProcAttr, lr)
+	}
 
 	outPipe, err = cmd.StdoutPipe()
 	if err != nil {
@@ -60,7 +80,7 @@ func (lr *LaunchRequest) start(extraFiles []*os.File) (cmd *exec.Cmd, outPipe, e
 		return
 	}
 
-	err = cmd.Start()
+	err = startCmd(cmd)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,104 @@
+package tasks
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/bradfitz/runsit/jsonconfig"
+)
+
+// Restart modes for the "restart" config block's "policy" key.
+const (
+	restartAlways    = "always"
+	restartOnFailure = "on-failure"
+	restartNever     = "never"
+)
+
+// restartPolicy is the parsed "restart" config block of a task. It
+// controls whether and when a task is restarted after its instance
+// exits.
+type restartPolicy struct {
+	mode     string        // restartAlways, restartOnFailure or restartNever
+	minDelay time.Duration // first restart delay after a healthy run
+	maxDelay time.Duration // cap on the exponentially growing delay
+	jitter   float64       // delay is randomized by +/- this fraction
+
+	// resetAfter is how long an instance must stay up for the
+	// backoff delay to reset back to minDelay.
+	resetAfter time.Duration
+
+	// The task is given up on (marked fatal) after maxFailures
+	// failures within failureWindow. Zero maxFailures means never.
+	maxFailures   int
+	failureWindow time.Duration
+}
+
+// parseRestartPolicy parses a task's "restart" config block. A oneshot
+// task is only restarted if it fails, so its policy defaults to
+// "on-failure", and can't be "always".
+func parseRestartPolicy(jc jsonconfig.Obj, oneshot bool) (*restartPolicy, error) {
+	defMode := restartAlways
+	if oneshot {
+		defMode = restartOnFailure
+	}
+	p := &restartPolicy{
+		mode:          jc.OptionalString("policy", defMode),
+		minDelay:      jc.OptionalDuration("minDelay", 1*time.Second),
+		maxDelay:      jc.OptionalDuration("maxDelay", 1*time.Minute),
+		resetAfter:    jc.OptionalDuration("resetAfter", 1*time.Minute),
+		maxFailures:   jc.OptionalInt("maxFailures", 0),
+		failureWindow: jc.OptionalDuration("failureWindow", 10*time.Minute),
+	}
+	jitterPct := jc.OptionalInt("jitterPercent", 10)
+	if err := jc.Validate(); err != nil {
+		return nil, err
+	}
+	switch p.mode {
+	case restartAlways, restartOnFailure, restartNever:
+	default:
+		return nil, fmt.Errorf("unknown policy %q; want %q, %q or %q",
+			p.mode, restartAlways, restartOnFailure, restartNever)
+	}
+	if oneshot && p.mode == restartAlways {
+		return nil, fmt.Errorf("policy %q doesn't apply to oneshot tasks", restartAlways)
+	}
+	if p.minDelay <= 0 || p.maxDelay < p.minDelay {
+		return nil, fmt.Errorf("want 0 < minDelay <= maxDelay; got %v and %v", p.minDelay, p.maxDelay)
+	}
+	if jitterPct < 0 || jitterPct > 100 {
+		return nil, fmt.Errorf("jitterPercent %d out of range [0, 100]", jitterPct)
+	}
+	p.jitter = float64(jitterPct) / 100
+	return p, nil
+}
+
+// shouldRestart reports whether an instance that exited, successfully
+// or not, should be restarted.
+func (p *restartPolicy) shouldRestart(failed bool) bool {
+	switch p.mode {
+	case restartAlways:
+		return true
+	case restartOnFailure:
+		return failed
+	}
+	return false
+}
+
+// nextDelay returns the backoff delay following prev, the previous
+// delay (or zero after a healthy run).
+func (p *restartPolicy) nextDelay(prev time.Duration) time.Duration {
+	d := prev * 2
+	if d < p.minDelay {
+		d = p.minDelay
+	}
+	if d > p.maxDelay {
+		d = p.maxDelay
+	}
+	return d
+}
+
+// withJitter returns d randomized by the policy's jitter fraction.
+func (p *restartPolicy) withJitter(d time.Duration) time.Duration {
+	return d + time.Duration(p.jitter*(2*rand.Float64()-1)*float64(d))
+}
@@ -0,0 +1,153 @@
+package tasks
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Rlimit is a resource limit the child sets before dropping root; see
+// LaunchRequest.Rlimits.
+type Rlimit struct {
+	Name     string // as in the "rlimits" config, such as "core"
+	Resource int    // such as syscall.RLIMIT_CORE
+	Cur, Max uint64 // soft and hard limits; rlimInfinity for unlimited
+}
+
+// rlimitResources maps the names allowed in a task's "rlimits" config
+// to resources.
+var rlimitResources = map[string]int{
+	"as":      syscall.RLIMIT_AS,
+	"core":    syscall.RLIMIT_CORE,
+	"cpu":     syscall.RLIMIT_CPU,
+	"fsize":   syscall.RLIMIT_FSIZE,
+	"memlock": rlimitMEMLOCK,
+	"nofile":  syscall.RLIMIT_NOFILE,
+	"nproc":   rlimitNPROC,
+	"stack":   syscall.RLIMIT_STACK,
+}
+
+// parseRlimits parses a task's "rlimits" config object. Each value is
+// a number or "unlimited", setting both the soft and hard limits, or
+// an object with "soft" and "hard" keys. numFiles, from the older
+// "numFiles" key, is the same as setting nofile. userNS is whether
+// the task runs in a user namespace, where it can't raise its hard
+// limits even as root.
+func parseRlimits(conf map[string]interface{}, numFiles int, userNS bool) ([]Rlimit, error) {
+	var rls []Rlimit
+	for name, v := range conf {
+		if strings.HasPrefix(name, "_") {
+			continue // comment, or jsonconfig bookkeeping
+		}
+		res, ok := rlimitResources[name]
+		if !ok {
+			var names []string
+			for n := range rlimitResources {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown rlimit %q; want one of %s", name, strings.Join(names, ", "))
+		}
+		rl := Rlimit{Name: name, Resource: res}
+		var err error
+		if m, ok := v.(map[string]interface{}); ok {
+			for k := range m {
+				if k != "soft" && k != "hard" {
+					return nil, fmt.Errorf("rlimit %q: unknown key %q; want \"soft\" and \"hard\"", name, k)
+				}
+			}
+			if rl.Cur, err = rlimitValue(m["soft"]); err == nil {
+				rl.Max, err = rlimitValue(m["hard"])
+			}
+		} else {
+			rl.Cur, err = rlimitValue(v)
+			rl.Max = rl.Cur
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rlimit %q: %v", name, err)
+		}
+		if rl.Cur > rl.Max {
+			return nil, fmt.Errorf("rlimit %q: soft limit above hard limit", name)
+		}
+		rls = append(rls, rl)
+	}
+	if numFiles != 0 {
+		if _, ok := conf["nofile"]; ok {
+			return nil, fmt.Errorf("numFiles and rlimits nofile both set")
+		}
+		rls = append(rls, Rlimit{Name: "nofile", Resource: syscall.RLIMIT_NOFILE, Cur: uint64(numFiles), Max: uint64(numFiles)})
+	}
+	sort.Sort(byRlimitName(rls))
+
+	// The child sets its limits before it drops root, but raising
+	// hard limits takes CAP_SYS_RESOURCE outside of a user
+	// namespace; without it the child can't exceed runsit's own.
+	raise := !userNS && canRaiseRlimits()
+	for _, rl := range rls {
+		if rl.Resource == syscall.RLIMIT_NOFILE {
+			if max := maxNofile(); max > 0 && rl.Max > max {
+				return nil, fmt.Errorf("rlimit %q: hard limit %s above the system maximum (fs.nr_open) of %d", rl.Name, rlimitString(rl.Max), max)
+			}
+		}
+		if raise {
+			continue
+		}
+		var lim syscall.Rlimit
+		if err := syscall.Getrlimit(rl.Resource, &lim); err != nil {
+			return nil, fmt.Errorf("rlimit %q: %v", rl.Name, err)
+		}
+		if max := uint64(lim.Max); max < rlimInfinity && rl.Max > max {
+			return nil, fmt.Errorf("rlimit %q: hard limit %s above runsit's own hard limit %d", rl.Name, rlimitString(rl.Max), max)
+		}
+	}
+	return rls, nil
+}
+
+// canRaiseRlimits reports whether runsit can raise hard limits: if
+// it's root and, on Linux, has CAP_SYS_RESOURCE, which containers
+// often drop.
+func canRaiseRlimits() bool {
+	if os.Geteuid() != 0 {
+		return false
+	}
+	if runtime.GOOS != "linux" {
+		return true
+	}
+	const capSysResource = 24
+	mask, err := effectiveCapMask(os.Getpid())
+	return err != nil || mask&(1<<capSysResource) != 0
+}
+
+func rlimitValue(v interface{}) (uint64, error) {
+	switch v := v.(type) {
+	case float64:
+		if v < 0 || v != math.Trunc(v) || v >= rlimInfinity {
+			return 0, fmt.Errorf("invalid value %v", v)
+		}
+		return uint64(v), nil
+	case string:
+		if v == "unlimited" {
+			return rlimInfinity, nil
+		}
+	case nil:
+		return 0, fmt.Errorf("missing soft or hard limit")
+	}
+	return 0, fmt.Errorf("invalid value %v; want a number or \"unlimited\"", v)
+}
+
+func rlimitString(v uint64) string {
+	if v == rlimInfinity {
+		return "unlimited"
+	}
+	return fmt.Sprint(v)
+}
+
+type byRlimitName []Rlimit
+
+func (s byRlimitName) Len() int           { return len(s) }
+func (s byRlimitName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s byRlimitName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,18 @@
+// +build darwin freebsd netbsd openbsd
+
+package tasks
+
+import "math"
+
+// Resources missing from package syscall, and RLIM_INFINITY.
+const (
+	rlimitMEMLOCK = 0x6
+	rlimitNPROC   = 0x7
+	rlimInfinity  = math.MaxInt64
+)
+
+// maxNofile returns the most the nofile limit may be set to, or 0 if
+// unknown, as it is here.
+func maxNofile() uint64 {
+	return 0
+}
@@ -0,0 +1,28 @@
+package tasks
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Resources missing from package syscall, and RLIM_INFINITY.
+const (
+	rlimitMEMLOCK = 0x8
+	rlimitNPROC   = 0x6
+	rlimInfinity  = 1<<64 - 1
+)
+
+// maxNofile returns the most the nofile limit may be set to, even by
+// root: fs.nr_open. It's 0 if unknown.
+func maxNofile() uint64 {
+	b, err := ioutil.ReadFile("/proc/sys/fs/nr_open")
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
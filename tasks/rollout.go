@@ -0,0 +1,126 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Values of a task's "rollout" config key, which says how running
+// instances are replaced when the config changes.
+const (
+	rolloutStopFirst = "stop-first" // stop the old instance, then start the new one
+	rolloutOverlap   = "overlap"    // start the new one, and stop the old once the new is ready
+)
+
+// rolloutConfig is a task's parsed rollout config.
+type rolloutConfig struct {
+	mode string
+
+	// readyTimeout is how long a new instance has to become ready
+	// before the rollout is abandoned and the old instance kept.
+	readyTimeout time.Duration
+
+	// readyDelay is, for tasks without a health check, how long a
+	// new instance must stay up to count as ready.
+	readyDelay time.Duration
+}
+
+func parseRollout(mode string, readyTimeout, readyDelay time.Duration) (*rolloutConfig, error) {
+	switch mode {
+	case rolloutStopFirst, rolloutOverlap:
+	default:
+		return nil, fmt.Errorf("unknown rollout %q; want %q or %q", mode, rolloutStopFirst, rolloutOverlap)
+	}
+	if readyTimeout <= 0 || readyDelay < 0 {
+		return nil, fmt.Errorf("readyTimeout must be positive and readyDelay non-negative")
+	}
+	return &rolloutConfig{mode: mode, readyTimeout: readyTimeout, readyDelay: readyDelay}, nil
+}
+
+// anyRunning reports whether any of the task's replicas has a running
+// instance.
+// run in Task.loop
+func (t *Task) anyRunning() bool {
+	for _, r := range t.replicas {
+		if r.running != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// awaitReady arranges for Task.loop to hear when in, the next instance
+// of its replica, is ready or has taken too long. Tasks with a health
+// check or readyNotify set are ready once those say so (see
+// TaskInstance.ready) instead of after readyDelay.
+// run in Task.loop
+func (t *Task) awaitReady(in *TaskInstance) {
+	if in.healthCheck == nil && !in.readyNotify {
+		time.AfterFunc(in.rollout.readyDelay, func() {
+			t.controlc <- readyMessage{in, false}
+		})
+	}
+	time.AfterFunc(in.rollout.readyTimeout, func() {
+		t.controlc <- readyMessage{in, true}
+	})
+}
+
+// run in Task.loop
+func (t *Task) onReady(m readyMessage) {
+	in := m.in
+	if in != in.replica.next {
+		return // already promoted, failed or stopped
+	}
+	if m.timedOut {
+		in.failReason = fmt.Sprintf("not ready within %v", in.rollout.readyTimeout)
+		t.stopInstances([]*TaskInstance{in})
+		t.onNextFailed(in, in.failReason)
+		return
+	}
+	t.promote(in.replica)
+}
+
+// promote makes the replica's next instance its running one and stops
+// the old running instance.
+// run in Task.loop
+func (t *Task) promote(r *replica) {
+	old, in := r.running, r.next
+	r.running, r.next = in, nil
+	r.startErr = nil
+	if old == nil {
+		r.setState(StateRunning, "PID %d ready", in.Pid())
+		return
+	}
+	r.setState(StateRunning, "PID %d ready; stopping PID %d", in.Pid(), old.Pid())
+	t.stopInstances([]*TaskInstance{old})
+	r.setState(StateRunning, "rolled out PID %d", in.Pid())
+}
+
+// onNextFailed abandons the rollout of in, the next instance of its
+// replica, keeping the replica's running instance.
+// run in Task.loop
+func (t *Task) onNextFailed(in *TaskInstance, reason string) {
+	r := in.replica
+	r.next = nil
+	in.Printf("rollout failed: %s", reason)
+	if r.running != nil {
+		what := "rollout"
+		if pid := in.Pid(); pid != 0 {
+			what = fmt.Sprintf("rollout of PID %d", pid)
+		}
+		r.setState(StateRunning, "%s failed (%s); kept PID %d", what, reason, r.running.Pid())
+	}
+}
+
+// nextStartFailed records that in, to be the next instance of its
+// replica, failed to start, as a failure of the replica, and abandons
+// its rollout. It returns the failure as an error.
+// run in Task.loop
+func (t *Task) nextStartFailed(in *TaskInstance, format string, args ...interface{}) error {
+	in.failReason = fmt.Sprintf(format, args...)
+	in.endTime = time.Now()
+	in.replica.addFailure(in)
+	t.onNextFailed(in, in.failReason)
+	return errors.New(in.failReason)
+}
@@ -0,0 +1,72 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/bradfitz/runsit/jsonconfig"
+)
+
+// Sandbox is the parsed "sandbox" config block of a task: Linux
+// namespaces to run it in, and how to set up its mounts. The
+// namespaces are created by LaunchRequest.start; the child sets up
+// the mounts before dropping root.
+//
+// Ports still work with a private network namespace, since runsit
+// opens them and passes them in as fds.
+//
+// With a private PID namespace, PID 1 in it is runsit's child acting
+// as init, which runs the task's binary as its own child and forwards
+// it signals. The instance's PID, and its status, capabilities and
+// samples, are those of that init process, not of the binary.
+type Sandbox struct {
+	PID     bool // private PID namespace, with an init process; see above
+	IPC     bool
+	UTS     bool
+	Network bool // private network namespace with only loopback
+	User    bool // user namespace; required if runsit isn't root
+
+	Hostname      string   // if UTS is set; or empty to keep runsit's
+	ReadOnlyRoot  bool     // remount / read-only
+	PrivateTmp    bool     // fresh tmpfs on /tmp
+	ReadOnlyPaths []string // paths to bind-mount read-only on themselves
+}
+
+// parseSandbox parses a task's "sandbox" config block, or returns nil
+// if there was none.
+func parseSandbox(jc jsonconfig.Obj) (*Sandbox, error) {
+	if len(jc) == 0 {
+		return nil, nil
+	}
+	sb := &Sandbox{
+		PID:           jc.OptionalBool("pid", true),
+		IPC:           jc.OptionalBool("ipc", true),
+		UTS:           jc.OptionalBool("uts", true),
+		Network:       jc.OptionalBool("network", false),
+		User:          jc.OptionalBool("user", os.Geteuid() != 0),
+		Hostname:      jc.OptionalString("hostname", ""),
+		ReadOnlyRoot:  jc.OptionalBool("readOnlyRoot", false),
+		PrivateTmp:    jc.OptionalBool("privateTmp", false),
+		ReadOnlyPaths: jc.OptionalList("readOnlyPaths"),
+	}
+	if err := jc.Validate(); err != nil {
+		return nil, err
+	}
+	if !sandboxSupported {
+		return nil, errors.New("only supported on Linux")
+	}
+	if sb.Hostname != "" && !sb.UTS {
+		return nil, errors.New("hostname requires uts")
+	}
+	if !sb.User && os.Geteuid() != 0 {
+		return nil, errors.New("user namespace required when runsit isn't running as root")
+	}
+	for _, p := range sb.ReadOnlyPaths {
+		if !filepath.IsAbs(p) {
+			return nil, fmt.Errorf("readOnlyPaths: %q isn't absolute", p)
+		}
+	}
+	return sb, nil
+}
@@ -0,0 +1,50 @@
+package tasks
+
+import (
+	"os"
+	"syscall"
+)
+
+const sandboxSupported = true
+
+// setSysProcAttr sets the clone flags, and for a user namespace the
+// ID mappings, to start lr in the sandbox with.
+func (sb *Sandbox) setSysProcAttr(attr *syscall.SysProcAttr, lr *LaunchRequest) {
+	attr.Cloneflags = syscall.CLONE_NEWNS
+	for _, ns := range []struct {
+		on   bool
+		flag uintptr
+	}{
+		{sb.PID, syscall.CLONE_NEWPID},
+		{sb.IPC, syscall.CLONE_NEWIPC},
+		{sb.UTS, syscall.CLONE_NEWUTS},
+		{sb.Network, syscall.CLONE_NEWNET},
+		{sb.User, syscall.CLONE_NEWUSER},
+	} {
+		if ns.on {
+			attr.Cloneflags |= ns.flag
+		}
+	}
+	if !sb.User {
+		return
+	}
+	// The child is root in the namespace, as runsit's own user
+	// outside it. Only root may map other IDs too, such as those
+	// the child drops to.
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	if os.Getuid() != 0 {
+		return
+	}
+	if lr.Uid != 0 {
+		attr.UidMappings = append(attr.UidMappings, syscall.SysProcIDMap{ContainerID: lr.Uid, HostID: lr.Uid, Size: 1})
+	}
+	mapped := map[int]bool{0: true}
+	for _, gid := range append([]int{lr.Gid}, lr.Gids...) {
+		if !mapped[gid] {
+			mapped[gid] = true
+			attr.GidMappings = append(attr.GidMappings, syscall.SysProcIDMap{ContainerID: gid, HostID: gid, Size: 1})
+		}
+	}
+	attr.GidMappingsEnableSetgroups = true
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package tasks
+
+import "syscall"
+
+const sandboxSupported = false
+
+func (sb *Sandbox) setSysProcAttr(attr *syscall.SysProcAttr, lr *LaunchRequest) {
+	panic("sandbox not supported")
+}
@@ -0,0 +1,161 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bradfitz/runsit/jsonconfig"
+)
+
+// I/O scheduling classes, as used by ioprio_set.
+const (
+	IOClassNone       = 0 // leave as inherited
+	IOClassRealtime   = 1
+	IOClassBestEffort = 2
+	IOClassIdle       = 3
+)
+
+// MaxCPUs is how many CPUs a cpuAffinity may name, numbered from 0:
+// the size of the child's affinity mask.
+const MaxCPUs = 1024
+
+var ioClassNames = map[string]int{
+	"realtime":    IOClassRealtime,
+	"best-effort": IOClassBestEffort,
+	"idle":        IOClassIdle,
+}
+
+// Sched is how a task's process is scheduled, from its "nice",
+// "ioClass", "ioPriority", "cpuAffinity" and "oomScoreAdj" keys. The
+// child applies it before dropping root. Unset attributes are
+// inherited from runsit.
+type Sched struct {
+	SetNice bool
+	Nice    int // -20 (highest priority) to 19
+
+	IOClass    int // IOClass constant
+	IOPriority int // 0 (highest) to 7; not for IOClassIdle
+
+	CPUs    []int  // CPUs to run on, or nil for any
+	CPUList string // CPUs as configured, such as "0-3,6"
+
+	SetOOMScoreAdj bool
+	OOMScoreAdj    int // -1000 to 1000
+}
+
+// parseSched reads a task's scheduling keys from jc, returning nil if
+// there were none. The caller validates jc.
+func parseSched(jc jsonconfig.Obj) (*Sched, error) {
+	s := new(Sched)
+	_, s.SetNice = jc["nice"]
+	s.Nice = jc.OptionalInt("nice", 0)
+	ioClass := jc.OptionalString("ioClass", "")
+	_, setIOPrio := jc["ioPriority"]
+	s.IOPriority = jc.OptionalInt("ioPriority", 4)
+	s.CPUList = jc.OptionalString("cpuAffinity", "")
+	_, s.SetOOMScoreAdj = jc["oomScoreAdj"]
+	s.OOMScoreAdj = jc.OptionalInt("oomScoreAdj", 0)
+
+	if !s.SetNice && ioClass == "" && !setIOPrio && s.CPUList == "" && !s.SetOOMScoreAdj {
+		return nil, nil
+	}
+	if s.SetNice && (s.Nice < -20 || s.Nice > 19) {
+		return nil, errors.New("nice must be between -20 and 19")
+	}
+	if (ioClass != "" || setIOPrio || s.CPUList != "" || s.SetOOMScoreAdj) && !schedSupported {
+		return nil, errors.New("ioClass, ioPriority, cpuAffinity and oomScoreAdj only supported on Linux")
+	}
+	if ioClass == "" && setIOPrio {
+		ioClass = "best-effort"
+	}
+	if ioClass != "" {
+		var ok bool
+		if s.IOClass, ok = ioClassNames[ioClass]; !ok {
+			return nil, fmt.Errorf("unknown ioClass %q; want \"realtime\", \"best-effort\" or \"idle\"", ioClass)
+		}
+		if s.IOPriority < 0 || s.IOPriority > 7 {
+			return nil, errors.New("ioPriority must be between 0 and 7")
+		}
+		if s.IOClass == IOClassIdle {
+			if setIOPrio {
+				return nil, errors.New("ioPriority doesn't apply to ioClass \"idle\"")
+			}
+			s.IOPriority = 0
+		}
+	}
+	if s.CPUList != "" {
+		cpus, err := parseCPUList(s.CPUList)
+		if err != nil {
+			return nil, fmt.Errorf("cpuAffinity: %v", err)
+		}
+		allowed, err := allowedCPUs()
+		if err != nil {
+			return nil, fmt.Errorf("cpuAffinity: %v", err)
+		}
+		for _, c := range cpus {
+			if !allowed[c] {
+				return nil, fmt.Errorf("cpuAffinity: CPU %d isn't available to runsit", c)
+			}
+		}
+		s.CPUs = cpus
+	}
+	if s.SetOOMScoreAdj && (s.OOMScoreAdj < -1000 || s.OOMScoreAdj > 1000) {
+		return nil, errors.New("oomScoreAdj must be between -1000 and 1000")
+	}
+	return s, nil
+}
+
+// parseCPUList parses a list of CPUs and ranges of CPUs, such as
+// "0-3,6".
+func parseCPUList(list string) ([]int, error) {
+	var cpus []int
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		lo, hi := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			lo, hi = part[:i], part[i+1:]
+		}
+		l, lerr := strconv.Atoi(lo)
+		h, herr := strconv.Atoi(hi)
+		if lerr != nil || herr != nil || l < 0 || h < l {
+			return nil, fmt.Errorf("invalid CPU or range %q", part)
+		}
+		if h >= MaxCPUs {
+			return nil, fmt.Errorf("CPU %d is over the maximum of %d", h, MaxCPUs-1)
+		}
+		for c := l; c <= h; c++ {
+			if !seen[c] {
+				seen[c] = true
+				cpus = append(cpus, c)
+			}
+		}
+	}
+	return cpus, nil
+}
+
+func (s *Sched) String() string {
+	var parts []string
+	if s.SetNice {
+		parts = append(parts, fmt.Sprintf("nice %d", s.Nice))
+	}
+	for name, class := range ioClassNames {
+		if class != s.IOClass {
+			continue
+		}
+		if class == IOClassIdle {
+			parts = append(parts, "I/O class idle")
+		} else {
+			parts = append(parts, fmt.Sprintf("I/O class %s, priority %d", name, s.IOPriority))
+		}
+	}
+	if s.CPUList != "" {
+		parts = append(parts, "CPUs "+s.CPUList)
+	}
+	if s.SetOOMScoreAdj {
+		parts = append(parts, fmt.Sprintf("oom_score_adj %d", s.OOMScoreAdj))
+	}
+	return strings.Join(parts, "; ")
+}
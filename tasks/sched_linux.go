@@ -0,0 +1,26 @@
+package tasks
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const schedSupported = true
+
+// allowedCPUs returns the CPUs runsit may run on.
+func allowedCPUs() (map[int]bool, error) {
+	var mask [MaxCPUs / 64]uint64
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_GETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		return nil, errno
+	}
+	cpus := make(map[int]bool)
+	for i, word := range mask {
+		for b := uint(0); b < 64; b++ {
+			if word&(1<<b) != 0 {
+				cpus[i*64+int(b)] = true
+			}
+		}
+	}
+	return cpus, nil
+}
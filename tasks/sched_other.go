@@ -0,0 +1,11 @@
+// +build !linux
+
+package tasks
+
+import "errors"
+
+const schedSupported = false
+
+func allowedCPUs() (map[int]bool, error) {
+	return nil, errors.New("not supported")
+}
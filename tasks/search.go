@@ -0,0 +1,144 @@
+package tasks
+
+import (
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// SearchQuery selects lines of a task's in-memory output; see
+// Task.Search. Its zero value matches every line.
+type SearchQuery struct {
+	Regexp   *regexp.Regexp  // if non-nil, lines must match it
+	Streams  map[string]bool // if non-nil, lines must be from one of these streams
+	Since    time.Time       // if non-zero, lines must be output at or after it
+	Until    time.Time       // if non-zero, lines must be output before it
+	Instance string          // if non-empty, the ID or PID of the only instance to search
+	Filters  []*FieldFilter  // lines must match all of them
+	Context  int             // lines of output to include before and after each match
+	Limit    int             // maximum matching lines to return, or 0 for no limit
+}
+
+// matches reports whether l matches q.
+func (q *SearchQuery) matches(l *Line) bool {
+	if q.Streams != nil && !q.Streams[l.Name] {
+		return false
+	}
+	if !q.Since.IsZero() && l.T.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !l.T.Before(q.Until) {
+		return false
+	}
+	if !MatchFilters(l, q.Filters) {
+		return false
+	}
+	return q.Regexp == nil || q.Regexp.MatchString(l.Data)
+}
+
+// wantInstance reports whether q searches in's output.
+func (q *SearchQuery) wantInstance(in *TaskInstance) bool {
+	return q.Instance == "" || q.Instance == in.ID() || q.Instance == strconv.Itoa(in.Pid())
+}
+
+// SearchLine is a line of search results: a matching line, or one
+// of its context.
+type SearchLine struct {
+	*Line
+	Match bool
+}
+
+// SearchResult is the matches of a search in one instance's output.
+type SearchResult struct {
+	Instance *TaskInstance
+	Replica  int
+	Kind     string // "running", "next", "completed" or "failure"
+
+	// Hunks are runs of consecutive output lines, each with at
+	// least one match, in the order they were output.
+	Hunks [][]SearchLine
+}
+
+// SearchResults is the result of Task.Search.
+type SearchResults struct {
+	Results   []*SearchResult // instances with matches; running ones first, then newest first
+	Matches   int             // total matching lines
+	Truncated bool            // whether the query's Limit cut the search short
+}
+
+// Search searches the output its instances still have in memory: of
+// its running instances, those being rolled out, and its replicas'
+// retained failures and last completed instances.
+func (t *Task) Search(q *SearchQuery) *SearchResults {
+	res := new(SearchResults)
+	for _, rs := range t.Status().Replicas {
+		type kindInstance struct {
+			kind string
+			in   *TaskInstance
+		}
+		ins := []kindInstance{{"running", rs.Running}, {"next", rs.Next}}
+		for i := len(rs.Failures) - 1; i >= 0; i-- {
+			ins = append(ins, kindInstance{"failure", rs.Failures[i]})
+		}
+		ins = append(ins, kindInstance{"completed", rs.Completed})
+		for _, ki := range ins {
+			if ki.in == nil || !q.wantInstance(ki.in) {
+				continue
+			}
+			if sr := ki.in.search(q, res); sr != nil {
+				sr.Replica = rs.Index
+				sr.Kind = ki.kind
+				res.Results = append(res.Results, sr)
+			}
+			if res.Truncated {
+				return res
+			}
+		}
+	}
+	return res
+}
+
+// search returns the matches of q in the instance's output, or nil
+// if there are none, counting them in res.
+func (in *TaskInstance) search(q *SearchQuery, res *SearchResults) *SearchResult {
+	lines := in.Output()
+	var hunks [][]SearchLine
+	end := 0 // index of the line after the last one in hunks
+	for i, l := range lines {
+		if !q.matches(l) {
+			continue
+		}
+		if q.Limit > 0 && res.Matches == q.Limit {
+			res.Truncated = true
+			break
+		}
+		res.Matches++
+		if i < end {
+			// Already added, as context of the match before.
+			h := hunks[len(hunks)-1]
+			h[len(h)-(end-i)].Match = true
+		} else {
+			start := i - q.Context
+			if start < end {
+				start = end
+			}
+			if start > end || len(hunks) == 0 {
+				hunks = append(hunks, nil)
+			}
+			h := &hunks[len(hunks)-1]
+			for _, cl := range lines[start:i] {
+				*h = append(*h, SearchLine{cl, false})
+			}
+			*h = append(*h, SearchLine{l, true})
+			end = i + 1
+		}
+		h := &hunks[len(hunks)-1]
+		for ; end < len(lines) && end <= i+q.Context; end++ {
+			*h = append(*h, SearchLine{lines[end], false})
+		}
+	}
+	if len(hunks) == 0 {
+		return nil
+	}
+	return &SearchResult{Instance: in, Hunks: hunks}
+}
@@ -0,0 +1,105 @@
+package tasks
+
+import (
+	"fmt"
+	"time"
+)
+
+// TaskState is where a Task is in its lifecycle.
+type TaskState int
+
+const (
+	StateStarting    TaskState = iota // loading config and launching an instance
+	StateWaiting                      // waiting for the tasks it depends on to be running
+	StateRunning                      // an instance is running
+	StateStopping                     // waiting for an instance to exit after its stop signal
+	StateStopped                      // stopped by an operator; not restarting until started again
+	StateExited                       // exited and not restarted, per the restart policy
+	StateBackoff                      // waiting to restart after an exit
+	StateConfigError                  // the config file is invalid
+	StateStartError                   // the config is valid, but the instance failed to launch
+	StateFatal                        // too many recent failures; not restarting until the config changes
+	StateCompleted                    // a oneshot task ran successfully; not running again until the config changes
+)
+
+var stateNames = map[TaskState]string{
+	StateStarting:    "starting",
+	StateWaiting:     "waiting",
+	StateRunning:     "running",
+	StateStopping:    "stopping",
+	StateStopped:     "stopped-by-operator",
+	StateExited:      "exited",
+	StateBackoff:     "backoff",
+	StateConfigError: "config-error",
+	StateStartError:  "start-error",
+	StateFatal:       "fatal",
+	StateCompleted:   "completed",
+}
+
+func (s TaskState) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("TaskState(%d)", int(s))
+}
+
+// StateTransition records a Task (or one of its replicas) entering a
+// state.
+type StateTransition struct {
+	State  TaskState
+	Time   time.Time
+	Reason string
+}
+
+// keepTransitions is how many StateTransitions each replica remembers.
+const keepTransitions = 20
+
+// setState moves every replica of the task to state s.
+// run in Task.loop
+func (t *Task) setState(s TaskState, format string, args ...interface{}) {
+	for _, r := range t.replicas {
+		r.setState(s, format, args...)
+	}
+}
+
+// setIdleState moves the replicas of the task without a running
+// instance to state s. Those with one keep their state, such as when
+// an overlap rollout's new config can't be started yet.
+// run in Task.loop
+func (t *Task) setIdleState(s TaskState, format string, args ...interface{}) {
+	for _, r := range t.replicas {
+		if r.running == nil {
+			r.setState(s, format, args...)
+		}
+	}
+}
+
+// setState moves the replica to state s, recording the transition in
+// its history. Repeating the current state and reason is a no-op.
+// run in Task.loop
+func (r *replica) setState(s TaskState, format string, args ...interface{}) {
+	tr := StateTransition{
+		State:  s,
+		Time:   time.Now(),
+		Reason: fmt.Sprintf(format, args...),
+	}
+	if n := len(r.history); n > 0 && r.state == s && r.history[n-1].Reason == tr.Reason {
+		return
+	}
+	r.state = s
+	if len(r.history) == keepTransitions {
+		copy(r.history, r.history[1:])
+		r.history = r.history[:keepTransitions-1]
+	}
+	r.history = append(r.history, tr)
+	r.Printf("state %s: %s", s, tr.Reason)
+}
+
+// stateTime returns the time the replica entered its current state.
+// run in Task.loop
+func (r *replica) stateTime() time.Time {
+	if len(r.history) == 0 {
+		return time.Time{}
+	}
+	return r.history[len(r.history)-1].Time
+}
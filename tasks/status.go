@@ -2,31 +2,130 @@ package tasks
 
 import (
 	"fmt"
+	"strings"
 	"time"
 )
 
 // TaskStatus is an one-time snapshot of a task's status, for rendering in
 // the web UI.
 type TaskStatus struct {
-	Running  *TaskInstance   // or nil, if none running
-	StartErr error           // if a task is not running, the reason why it failed to start
-	ErrTime  time.Time       // time of StartErr
-	StartIn  time.Duration   // non-zero if task is rate-limited and will restart in this time
-	Failures []*TaskInstance // past few failures
+	// ConfigErr is the problem with the config, if any. Replicas
+	// still running the previous config aren't in StateConfigError.
+	ConfigErr error
+	ErrTime   time.Time // time of ConfigErr
+
+	RestartPolicy string // "always", "on-failure", "never", or empty if never started
+
+	Replicas []*ReplicaStatus // always at least one
+}
+
+// ReplicaStatus is the status of one of a task's replicas.
+type ReplicaStatus struct {
+	Index     int
+	State     TaskState
+	StateTime time.Time         // when State was entered
+	History   []StateTransition // recent state transitions, oldest first
+
+	Running   *TaskInstance   // or nil, if none running
+	Next      *TaskInstance   // or nil; the instance being rolled out to replace Running
+	StartErr  error           // if State is StateStartError, the reason the replica failed to start
+	ErrTime   time.Time       // time of StartErr
+	StartIn   time.Duration   // non-zero if the replica is rate-limited and will restart in this time
+	Failures  []*TaskInstance // past few failures
+	Completed *TaskInstance   // last instance to exit successfully, or nil
+	Health    *HealthStatus   // of Running, if it has a health check
+
+	// ChildStatus is the status Running last reported with a
+	// STATUS= notify message (see package notify).
+	ChildStatus string
+
+	// Resources is the resource usage of Running, if it has a
+	// cgroup.
+	Resources *CgroupStats
+
+	// Capabilities are Running's effective capabilities, such as
+	// "cap_net_bind_service", "all" or "none", if known.
+	Capabilities string
+
+	// Process is the latest sample of Running's process, if any.
+	Process *ProcSample
+
+	// Descendants are Running's other processes, such as
+	// "1234 (perl)", as of its last scan.
+	Descendants []string
+
+	task *TaskStatus
 }
 
 func (s *TaskStatus) Summary() string {
-	in := s.Running
-	if in != nil {
-		return "ok"
+	sum := s.replicasSummary()
+	if s.ConfigErr == nil {
+		return sum
+	}
+	for _, rs := range s.Replicas {
+		if rs.State != StateConfigError {
+			return fmt.Sprintf("%s; new config rejected (%v ago): %v", sum, roundDuration(time.Now().Sub(s.ErrTime)), s.ConfigErr)
+		}
+	}
+	return sum
+}
+
+func (s *TaskStatus) replicasSummary() string {
+	if len(s.Replicas) == 1 {
+		return s.Replicas[0].Summary()
 	}
-	if err := s.StartErr; err != nil {
-		return fmt.Sprintf("Start error (%v ago): %v", time.Now().Sub(s.ErrTime), err)
+	ok := 0
+	var probs []string
+	for _, rs := range s.Replicas {
+		sum := rs.Summary()
+		if sum == "ok" {
+			ok++
+			continue
+		}
+		probs = append(probs, fmt.Sprintf("replica %d: %s", rs.Index, sum))
 	}
-	// TODO: flesh these not running states out.
-	// e.g. intentionaly stopped, how long we're pausing before
-	// next re-start attempt, etc.
-	return "not running"
+	if len(probs) == 0 {
+		return fmt.Sprintf("ok (%d replicas)", ok)
+	}
+	return fmt.Sprintf("%d/%d replicas ok; %s", ok, len(s.Replicas), strings.Join(probs, "; "))
+}
+
+func (s *ReplicaStatus) Summary() string {
+	ago := roundDuration(time.Now().Sub(s.StateTime))
+	switch s.State {
+	case StateRunning:
+		if h := s.Health; h != nil && !h.Checked.IsZero() && !h.Healthy {
+			return "ok, but unhealthy: " + h.String()
+		}
+		if s.Next != nil {
+			return fmt.Sprintf("ok; rolling out PID %d", s.Next.Pid())
+		}
+		return "ok"
+	case StateConfigError:
+		return fmt.Sprintf("Config error (%v ago): %v", roundDuration(time.Now().Sub(s.task.ErrTime)), s.task.ConfigErr)
+	case StateStartError:
+		return fmt.Sprintf("Start error (%v ago): %v", roundDuration(time.Now().Sub(s.ErrTime)), s.StartErr)
+	case StateBackoff:
+		return fmt.Sprintf("backing off, next attempt in %v", roundDuration(s.StartIn))
+	case StateStopped:
+		return fmt.Sprintf("stopped by operator %v ago", ago)
+	case StateWaiting, StateStarting:
+		if len(s.History) > 0 {
+			return fmt.Sprintf("%s (for %v)", s.History[len(s.History)-1].Reason, ago)
+		}
+	case StateStopping:
+		return fmt.Sprintf("stopping for %v", ago)
+	case StateExited:
+		return fmt.Sprintf("exited %v ago; restart policy %q", ago, s.task.RestartPolicy)
+	case StateCompleted:
+		if in := s.Completed; in != nil && in.Exit() != nil {
+			return fmt.Sprintf("completed at %s (exit %d)", in.endTime.Format("2006-01-02 15:04:05"), in.Exit().Code)
+		}
+		return "completed"
+	case StateFatal:
+		return fmt.Sprintf("fatal: too many failures; restart policy %q gave up %v ago", s.task.RestartPolicy, ago)
+	}
+	return s.State.String()
 }
 
 // Status returns the task's status.
@@ -38,15 +137,58 @@ func (t *Task) Status() *TaskStatus {
 
 // runs in Task.loop
 func (t *Task) status() *TaskStatus {
-	failures := make([]*TaskInstance, len(t.failures))
-	copy(failures, t.failures)
 	s := &TaskStatus{
-		Running:  t.running,
-		Failures: failures,
+		ConfigErr: t.configErr,
+		ErrTime:   t.errTime,
+	}
+	if t.restart != nil {
+		s.RestartPolicy = t.restart.mode
+	}
+	for _, r := range t.replicas {
+		s.Replicas = append(s.Replicas, r.status(s))
+	}
+	return s
+}
+
+// runs in Task.loop
+func (r *replica) status(ts *TaskStatus) *ReplicaStatus {
+	failures := make([]*TaskInstance, len(r.failures))
+	copy(failures, r.failures)
+	history := make([]StateTransition, len(r.history))
+	copy(history, r.history)
+	s := &ReplicaStatus{
+		Index:     r.index,
+		State:     r.state,
+		StateTime: r.stateTime(),
+		History:   history,
+		Running:   r.running,
+		Next:      r.next,
+		StartErr:  r.startErr,
+		ErrTime:   r.errTime,
+		Failures:  failures,
+		Completed: r.completed,
+		task:      ts,
 	}
-	if t.running == nil {
-		s.StartErr = t.configErr
-		s.ErrTime = t.errTime
+	if in := r.running; in != nil && in.healthCheck != nil {
+		h := in.health
+		s.Health = &h
+	}
+	if in := r.running; in != nil {
+		s.ChildStatus = in.childStatus
+		if in.cgroup != "" {
+			s.Resources = readCgroupStats(in.cgroup)
+		}
+		s.Capabilities, _ = effectiveCaps(in.Pid())
+		s.Descendants = in.Descendants()
+		s.Process = in.Sample()
+	}
+	if r.restartTimer != nil {
+		s.StartIn = r.restartAt.Sub(time.Now())
 	}
 	return s
 }
+
+// roundDuration rounds d to the nearest second, for display.
+func roundDuration(d time.Duration) time.Duration {
+	return (d + time.Second/2) / time.Second * time.Second
+}
@@ -0,0 +1,103 @@
+package tasks
+
+import (
+	"sort"
+	"sync"
+)
+
+// watcherBuffer is how many lines a LineWatcher buffers before it
+// starts dropping them.
+const watcherBuffer = 1000
+
+// lineHub numbers a task's output lines and passes them on to the
+// task's LineWatchers, for live streaming. Safe for concurrent use.
+type lineHub struct {
+	mu       sync.Mutex
+	seq      int64
+	watchers map[*LineWatcher]bool
+}
+
+// publish numbers l, passes it to keep to buffer it, and sends it to
+// the watchers, dropping it for any that have fallen behind. Doing
+// that all at once means a new watcher gets each line either from a
+// buffer or sent to it, never neither or both; see WatchOutput.
+func (h *lineHub) publish(l *Line, keep func(*Line)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	l.Seq = h.seq
+	keep(l)
+	for w := range h.watchers {
+		select {
+		case w.c <- l:
+		default:
+			w.dropped++
+		}
+	}
+}
+
+// LineWatcher receives a task's new output lines, as they're output.
+type LineWatcher struct {
+	C <-chan *Line
+
+	c       chan *Line
+	hub     *lineHub
+	dropped int // guarded by hub.mu
+}
+
+// Dropped returns how many lines were dropped since the last call
+// because the watcher fell behind.
+func (w *LineWatcher) Dropped() int {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+	n := w.dropped
+	w.dropped = 0
+	return n
+}
+
+// Close stops sending lines to the watcher.
+func (w *LineWatcher) Close() {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+	delete(w.hub.watchers, w)
+}
+
+// WatchOutput returns the output lines numbered after after that its
+// running instances still have in memory, oldest first, and a
+// watcher for its lines from then on. No line is in both. The caller
+// must close the watcher.
+func (t *Task) WatchOutput(after int64) ([]*Line, *LineWatcher) {
+	w := &LineWatcher{c: make(chan *Line, watcherBuffer), hub: t.hub}
+	w.C = w.c
+	t.hub.mu.Lock()
+	if t.hub.watchers == nil {
+		t.hub.watchers = make(map[*LineWatcher]bool)
+	}
+	t.hub.watchers[w] = true
+	// Lines up to here are buffered, and only later ones are
+	// sent to w.
+	upTo := t.hub.seq
+	t.hub.mu.Unlock()
+
+	var lines []*Line
+	for _, rs := range t.Status().Replicas {
+		for _, in := range []*TaskInstance{rs.Running, rs.Next} {
+			if in == nil {
+				continue
+			}
+			for _, l := range in.Output() {
+				if l.Seq > after && l.Seq <= upTo {
+					lines = append(lines, l)
+				}
+			}
+		}
+	}
+	sort.Sort(bySeq(lines))
+	return lines, w
+}
+
+type bySeq []*Line
+
+func (s bySeq) Len() int           { return len(s) }
+func (s bySeq) Less(i, j int) bool { return s[i].Seq < s[j].Seq }
+func (s bySeq) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
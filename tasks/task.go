@@ -1,12 +1,14 @@
 package tasks
 
 import (
+	"errors"
 	"fmt"
-	"net"
 	"os"
 	"os/user"
 	"path/filepath"
-	"strconv"
+	"runtime"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -24,20 +26,42 @@ type Task struct {
 	Name     string
 	tf       TaskFile
 	controlc chan interface{}
+	log      *taskLog // internal locking; writes output to disk, if configured
+	hub      *lineHub // internal locking; streams output to watchers
 
 	// State owned by loop's goroutine:
 	config    jsonconfig.Obj // last valid config
 	configErr error          // configuration error
 	errTime   time.Time      // of last configErr
-	running   *TaskInstance
-	failures  []*TaskInstance // last few failures, oldest first.
+	replicas  []*replica     // always at least one
+	restart   *restartPolicy // of the most recently started instance
+	pending   []interface{}  // control messages queued by waitDone
+
+	// listeners are the listening sockets of the config's ports,
+	// keyed by listen address. runsit holds them open for the life
+	// of the task, so each new instance inherits the same socket
+	// and connections queue up rather than being refused while an
+	// instance restarts. They're only closed when no longer
+	// configured.
+	listeners map[string]*listener
+
+	// Published for other tasks' loops (see deps.go):
+	pubMu       sync.Mutex
+	pubState    TaskState
+	pubReady    bool     // running, and healthy if it has a health check
+	pubRequires []string // "requires" of the current config
+	pubAfter    []string // "after" of the current config
 }
 
 func NewTask(name string) *Task {
 	t := &Task{
-		Name:     name,
-		controlc: make(chan interface{}),
+		Name:      name,
+		controlc:  make(chan interface{}),
+		listeners: make(map[string]*listener),
+		log:       &taskLog{task: name},
+		hub:       new(lineHub),
 	}
+	t.setReplicas(1)
 	go t.loop()
 	return t
 }
@@ -49,7 +73,16 @@ func (t *Task) Printf(format string, args ...interface{}) {
 func (t *Task) loop() {
 	t.Printf("Starting")
 	defer t.Printf("Loop exiting")
-	for cm := range t.controlc {
+	for {
+		var cm interface{}
+		if len(t.pending) > 0 {
+			cm, t.pending = t.pending[0], t.pending[1:]
+		} else {
+			var ok bool
+			if cm, ok = <-t.controlc; !ok {
+				return
+			}
+		}
 		switch m := cm.(type) {
 		case statusRequestMessage:
 			m.resCh <- t.status()
@@ -57,12 +90,34 @@ func (t *Task) loop() {
 			t.update(m.tf)
 		case stopMessage:
 			err := t.stop()
+			if t.config != nil {
+				for _, r := range t.replicas {
+					r.cancelRestart()
+				}
+				t.setState(StateStopped, "stopped by operator")
+			}
 			m.resc <- err
+		case killMessage:
+			t.kill(m)
+		case startMessage:
+			t.start()
 		case instanceGoneMessage:
 			t.onTaskFinished(m)
+		case healthResultMessage:
+			t.onHealthResult(m)
+		case readyMessage:
+			t.onReady(m)
+		case notifyMessage:
+			t.onNotify(m)
+		case watchdogMessage:
+			t.onWatchdog(m)
 		case restartIfStoppedMessage:
-			t.restartIfStopped()
+			r := m.r
+			if m.gen == r.restartGen && r.index < len(t.replicas) && t.replicas[r.index] == r {
+				t.restartIfStopped(r)
+			}
 		}
+		t.publish()
 	}
 }
 
@@ -72,49 +127,163 @@ func (t *Task) Update(tf TaskFile) {
 
 // run in Task.loop
 func (t *Task) onTaskFinished(m instanceGoneMessage) {
-	m.in.Printf("Task exited; err=%v", m.in.waitErr)
-	if m.in == t.running {
-		t.running = nil
+	in := m.in
+	r := in.replica
+	if in.exitReason != "" {
+		in.Printf("Task exited: %s; err=%v", in.exitReason, in.waitErr)
+	} else {
+		in.Printf("Task exited; err=%v", in.waitErr)
+	}
+	in.stopWatchdog()
+	succeeded := in.succeeded()
+	if succeeded {
+		r.completed = in
+	} else {
+		r.addFailure(in)
+	}
+
+	if in == r.next {
+		t.onNextFailed(in, "exited before becoming ready")
+		return
 	}
-	const keepFailures = 5
-	if len(t.failures) == keepFailures {
-		copy(t.failures, t.failures[1:])
-		t.failures = t.failures[:keepFailures-1]
+	if in != r.running {
+		// Stopped on purpose, so not a failure for the
+		// restart policy. Whoever stopped it set the state.
+		return
+	}
+	r.running = nil
+	if succeeded && in.oneshot {
+		r.setState(StateCompleted, "completed (exit %d)", in.exit.Code)
+		t.checkMainExit(in)
+		return
 	}
-	t.failures = append(t.failures, m.in)
+	t.afterExit(in, !succeeded)
+}
 
-	aliveTime := m.in.endTime.Sub(m.in.StartTime)
-	restartIn := 0 * time.Second
-	if min := 5 * time.Second; aliveTime < min {
-		restartIn = min - aliveTime
+// afterExit applies the restart policy after in, formerly the running
+// instance of its replica, exited or was stopped for failing.
+// run in Task.loop
+func (t *Task) afterExit(in *TaskInstance, failed bool) {
+	r := in.replica
+	p := in.restart
+	endTime := time.Now()
+	if !in.endTime.IsZero() {
+		endTime = in.endTime
+	}
+	if endTime.Sub(in.StartTime) >= p.resetAfter {
+		r.backoff = 0
 	}
 
-	if m.in.waitErr == nil {
-		// TODO: vary restartIn based on whether this instance
-		// and the previous few completed successfully or not?
+	if failed && p.maxFailures > 0 {
+		r.recentFails = append(r.recentFails, endTime)
+		for len(r.recentFails) > 0 && endTime.Sub(r.recentFails[0]) > p.failureWindow {
+			r.recentFails = r.recentFails[1:]
+		}
+		if len(r.recentFails) >= p.maxFailures {
+			r.setState(StateFatal, "%d failures within %v; giving up until the config changes", len(r.recentFails), p.failureWindow)
+			t.checkMainExit(in)
+			return
+		}
 	}
 
-	time.AfterFunc(restartIn, func() {
-		t.controlc <- restartIfStoppedMessage{}
-	})
+	if !p.shouldRestart(failed) {
+		r.setState(StateExited, "exited (err=%v); restart policy is %q", in.waitErr, p.mode)
+		t.checkMainExit(in)
+		return
+	}
+	r.backoff = p.nextDelay(r.backoff)
+	r.scheduleRestart(p.withJitter(r.backoff))
 }
 
 // run in Task.loop
-func (t *Task) restartIfStopped() {
-	if t.running != nil || t.config == nil {
+func (t *Task) restartIfStopped(r *replica) {
+	r.cancelRestart()
+	if r.running != nil || t.config == nil {
 		return
 	}
-	t.Printf("Restarting")
-	t.updateFromConfig(t.config)
+	switch r.state {
+	case StateBackoff:
+		r.Printf("Restarting")
+		t.startReplicas(t.config, r, false)
+	case StateStartError:
+		t.startReplicas(t.config, r, false)
+	case StateWaiting, StateConfigError:
+		// Checking dependencies again, for every replica.
+		t.startReplicas(t.config, nil, false)
+	}
+}
+
+// Start starts a task that was stopped by an operator or has
+// exited and was not restarted.
+func (t *Task) Start() {
+	t.controlc <- startMessage{}
+}
+
+// run in Task.loop
+func (t *Task) start() {
+	if t.config == nil {
+		return
+	}
+	any := false
+	for _, r := range t.replicas {
+		switch r.state {
+		case StateStopped, StateExited, StateFatal, StateCompleted:
+			r.resetBackoff()
+			any = true
+		}
+	}
+	if any {
+		t.Printf("Started by operator")
+		t.startReplicas(t.config, nil, false)
+	}
+}
+
+// Kill stops the running instance with the given pid, after which
+// its replica is restarted as if the instance had exited on its own
+// (but without counting as a failure).
+func (t *Task) Kill(pid int) error {
+	errc := make(chan error, 1)
+	t.controlc <- killMessage{pid, errc}
+	return <-errc
+}
+
+// run in Task.loop
+func (t *Task) kill(m killMessage) {
+	r := t.replicaOf(m.pid)
+	if r == nil {
+		m.resc <- errors.New("active task pid doesn't match pid parameter")
+		return
+	}
+	p := r.running.restart
+	t.stopReplicas([]*replica{r})
+	r.scheduleRestart(p.minDelay)
+	m.resc <- nil
 }
 
 // run in Task.loop
 func (t *Task) update(tf TaskFile) {
+	fileName := tf.ConfigFileName()
+	t.configErr = nil
+	if fileName != "" && t.anyRunning() {
+		jc, err := jsonconfig.ReadFile(fileName)
+		if err == nil && jc["rollout"] == rolloutOverlap {
+			t.Printf("config updated; rolling out with overlap")
+			t.startReplicas(jc, nil, true)
+			return
+		}
+	}
+
 	t.config = nil
 	t.stop()
+	for _, r := range t.replicas {
+		r.resetBackoff()
+	}
+	t.setState(StateStarting, "config updated")
 
-	fileName := tf.ConfigFileName()
 	if fileName == "" {
+		t.setDeps(nil, nil)
+		t.closeListeners(nil)
+		t.log.setConfig(nil)
 		t.Printf("config file deleted; stopping")
 		DeleteTask(t.Name)
 		return
@@ -128,18 +297,35 @@ func (t *Task) update(tf TaskFile) {
 	t.updateFromConfig(jc)
 }
 
+// closeListeners closes the task's listeners other than those for
+// the addresses in keep.
 // run in Task.loop
-func (t *Task) configError(format string, args ...interface{}) error {
-	t.configErr = fmt.Errorf(format, args...)
-	t.errTime = time.Now()
-	t.Printf("%v", t.configErr)
-	return t.configErr
+func (t *Task) closeListeners(keep map[string]bool) {
+	for addr, ln := range t.listeners {
+		if keep[addr] {
+			continue
+		}
+		t.Printf("closing listener on %v", addr)
+		ln.f.Close()
+		delete(t.listeners, addr)
+	}
 }
 
 // run in Task.loop
-func (t *Task) startError(format string, args ...interface{}) error {
-	// TODO: make start error and config error different?
-	return t.configError(format, args...)
+func (t *Task) configError(format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	if t.configErr == nil || t.configErr.Error() != err.Error() {
+		// A new error, not a dependency check repeating itself.
+		t.errTime = time.Now()
+		if t.anyRunning() {
+			// They carry on with the previous config, so
+			// setIdleState won't log it for them.
+			t.Printf("new config rejected: %v", err)
+		}
+	}
+	t.configErr = err
+	t.setIdleState(StateConfigError, "%v", t.configErr)
+	return t.configErr
 }
 
 func (t *Task) Stop() error {
@@ -150,27 +336,101 @@ func (t *Task) Stop() error {
 
 // runs in Task.loop
 func (t *Task) stop() error {
-	in := t.running
-	if in == nil {
-		return nil
+	return t.stopReplicas(t.replicas)
+}
+
+// stopReplicas sends the running instances of rs their stop signals,
+// and then SIGKILL to any still running after their stop timeouts.
+// runs in Task.loop
+func (t *Task) stopReplicas(rs []*replica) error {
+	var stopping []*TaskInstance
+	for _, r := range rs {
+		if in := r.next; in != nil {
+			r.next = nil
+			stopping = append(stopping, in)
+		}
+		if in := r.running; in != nil {
+			r.setState(StateStopping, "stopping PID %d with %s", in.Pid(), signalName(in.stopSignal))
+			r.running = nil
+			stopping = append(stopping, in)
+		}
 	}
+	t.stopInstances(stopping)
+	return nil
+}
 
-	// TODO: more graceful kill types
-	in.Printf("sending SIGKILL")
+// stopInstances sends each of ins its stop signal, and then SIGKILL
+// to any still running after their stop timeouts. The instances must
+// no longer be their replicas' running (or next) instance.
+// runs in Task.loop
+func (t *Task) stopInstances(ins []*TaskInstance) {
+	for _, in := range ins {
+		in.signal(in.stopSignal)
+	}
+	start := time.Now()
+	for _, in := range ins {
+		if in.stopSignal == syscall.SIGKILL {
+			continue
+		}
+		if t.waitDone(in, in.stopTimeout-time.Now().Sub(start)) {
+			in.Printf("exited after %s", signalName(in.stopSignal))
+			continue
+		}
+		in.Printf("still running %v after %s", in.stopTimeout, signalName(in.stopSignal))
+		in.signal(syscall.SIGKILL)
+	}
+}
 
-	// Was: in.cmd.Process.Kill(); but we want to kill
-	// the entire process group.
-	processGroup := 0 - in.Pid()
-	rv := syscall.Kill(processGroup, 9)
-	in.Printf("Kill result: %v", rv)
-	t.running = nil
-	return nil
+// waitDone waits up to timeout for in to exit and reports whether it
+// did. Status requests are answered meanwhile, so the web UI can show
+// the task stopping; other messages are queued for loop.
+// runs in Task.loop
+func (t *Task) waitDone(in *TaskInstance, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-in.done:
+			return true
+		case <-timer.C:
+			return false
+		case cm := <-t.controlc:
+			if m, ok := cm.(statusRequestMessage); ok {
+				m.resCh <- t.status()
+				continue
+			}
+			t.pending = append(t.pending, cm)
+		}
+	}
 }
 
 // run in Task.loop
-func (t *Task) updateFromConfig(jc jsonconfig.Obj) (err error) {
+func (t *Task) updateFromConfig(jc jsonconfig.Obj) error {
 	t.config = nil
 	t.stop()
+	return t.startReplicas(jc, nil, false)
+}
+
+// startReplicas starts replica only, or if only is nil, every replica
+// not already running, once the task's dependencies are ready. If
+// overlap is set, replicas that are running get a new instance too,
+// which replaces the old one once it's ready (see rollout.go).
+// run in Task.loop
+func (t *Task) startReplicas(jc jsonconfig.Obj, only *replica, overlap bool) (err error) {
+	requires := jc.OptionalList("requires")
+	after := jc.OptionalList("after")
+	t.setDeps(requires, after)
+	waiting, err := t.checkDeps(requires, after)
+	if err != nil || len(waiting) > 0 {
+		t.config = jc
+		t.replicas[0].retryIn(depPollInterval)
+		if err != nil {
+			return t.configError("%v", err)
+		}
+		t.configErr = nil
+		t.setIdleState(StateWaiting, "waiting for %s", strings.Join(waiting, ", "))
+		return nil
+	}
 
 	env := []string{}
 	stdEnv := jc.OptionalBool("standardEnv", true)
@@ -223,55 +483,137 @@ func (t *Task) updateFromConfig(jc jsonconfig.Obj) (err error) {
 		env = append(env, "PATH=/usr/local/sbin:/usr/local/bin:/usr/bin:/usr/sbin:/sbin:/bin")
 	}
 
-	extraFiles := []*os.File{}
-	ports := jc.OptionalObject("ports")
-	for portName, vi := range ports {
-		var ln net.Listener
-		var err error
-		switch v := vi.(type) {
-		case float64:
-			ln, err = net.Listen("tcp", ":"+strconv.Itoa(int(v)))
-		case string:
-			ln, err = net.Listen("tcp", v)
-		default:
-			return t.configError("port %q value must be a string or integer", portName)
-		}
-		if err != nil {
-			restartIn := 5 * time.Second
-			time.AfterFunc(restartIn, func() {
-				t.controlc <- updateMessage{t.tf}
-			})
-			return t.startError("port %q listen error: %v; restarting in %v", portName, err, restartIn)
-		}
-		lf, err := ln.(*net.TCPListener).File()
-		if err != nil {
-			return t.startError("error getting file of port %q listener: %v", portName, err)
-		}
-		Logger.Printf("opened port named %q on %v; fd=%d", portName, vi, lf.Fd())
-		ln.Close()
-		env = append(env, fmt.Sprintf("RUNSIT_PORTFD_%s=%d", portName, 3+len(extraFiles)))
-		extraFiles = append(extraFiles, lf)
-		defer lf.Close()
+	portSpecs, err := parsePorts(jc.OptionalObject("ports"))
+	if err != nil {
+		return t.configError("%v", err)
 	}
 
 	bin := jc.RequiredString("binary")
 	dir := jc.OptionalString("cwd", "")
+	root := jc.OptionalString("root", "")
 	args := jc.OptionalList("args")
 	groups := jc.OptionalList("groups")
 	numFiles := jc.OptionalInt("numFiles", 0)
+	rlimitConf := jc.OptionalObject("rlimits")
+	sandboxConf := jc.OptionalObject("sandbox")
+	_, limitCaps := jc["capabilities"]
+	capNames := jc.OptionalList("capabilities")
+	noNewPrivs := jc.OptionalBool("noNewPrivileges", false)
+	sched, schedErr := parseSched(jc)
+	stopSignalStr := jc.OptionalString("stopSignal", "SIGTERM")
+	stopTimeout := jc.OptionalDuration("stopTimeout", 10*time.Second)
+	restartConf := jc.OptionalObject("restart")
+	healthConf := jc.OptionalObject("healthCheck")
+	numReplicas := jc.OptionalInt("replicas", 1)
+	rolloutMode := jc.OptionalString("rollout", rolloutStopFirst)
+	readyTimeout := jc.OptionalDuration("readyTimeout", 1*time.Minute)
+	readyDelay := jc.OptionalDuration("readyDelay", 2*time.Second)
+	readyNotify := jc.OptionalBool("readyNotify", false)
+	watchdog := jc.OptionalDuration("watchdogInterval", 0)
+	cgroupConf, cgroupConfErr := parseCgroupLimits(jc)
+	taskType := jc.OptionalString("type", typeDaemon)
+	successCodes, successCodesErr := parseSuccessExitCodes(jc)
+	_, hasLog := jc["log"]
+	logConf := jc.OptionalObject("log")
+	logFormat := jc.OptionalString("logFormat", formatText)
+	maxLineLengthStr := jc.OptionalString("maxLineLength", "64K")
 	if err := jc.Validate(); err != nil {
 		return t.configError("configuration error: %v", err)
 	}
 	t.config = jc
 
+	stopSignal, err := parseSignal(stopSignalStr)
+	if err != nil {
+		return t.configError("stopSignal: %v", err)
+	}
+	if taskType != typeDaemon && taskType != typeOneshot {
+		return t.configError("unknown type %q; want %q or %q", taskType, typeDaemon, typeOneshot)
+	}
+	oneshot := taskType == typeOneshot
+	if successCodesErr != nil {
+		return t.configError("%v", successCodesErr)
+	}
+	restart, err := parseRestartPolicy(restartConf, oneshot)
+	if err != nil {
+		return t.configError("restart: %v", err)
+	}
+	healthCheck, err := parseHealthCheck(healthConf, portSpecs)
+	if err != nil {
+		return t.configError("healthCheck: %v", err)
+	}
+	if stopTimeout <= 0 {
+		return t.configError("stopTimeout must be positive")
+	}
+	if numReplicas < 1 {
+		return t.configError("replicas must be at least 1")
+	}
+	if watchdog < 0 {
+		return t.configError("watchdogInterval must not be negative")
+	}
+	if cgroupConfErr != nil {
+		return t.configError("%v", cgroupConfErr)
+	}
+	rollout, err := parseRollout(rolloutMode, readyTimeout, readyDelay)
+	if err != nil {
+		return t.configError("%v", err)
+	}
+	if oneshot && (healthCheck != nil || readyNotify || rollout.mode == rolloutOverlap) {
+		return t.configError("oneshot tasks can't have a healthCheck, readyNotify or overlap rollout")
+	}
+	sandbox, err := parseSandbox(sandboxConf)
+	if err != nil {
+		return t.configError("sandbox: %v", err)
+	}
+	rlimits, err := parseRlimits(rlimitConf, numFiles, sandbox != nil && sandbox.User)
+	if err != nil {
+		return t.configError("rlimits: %v", err)
+	}
+	var caps []int
+	if limitCaps {
+		if caps, err = parseCapabilities(capNames); err != nil {
+			return t.configError("capabilities: %v", err)
+		}
+	}
+	if noNewPrivs && runtime.GOOS != "linux" {
+		return t.configError("noNewPrivileges only supported on Linux")
+	}
+	if schedErr != nil {
+		return t.configError("%v", schedErr)
+	}
+	logConfig, err := parseLogConfig(logConf, hasLog, t.Name)
+	if err != nil {
+		return t.configError("log: %v", err)
+	}
+	if err := checkLogFormat(logFormat); err != nil {
+		return t.configError("%v", err)
+	}
+	maxLineLength, err := parseMaxLineLength(maxLineLengthStr)
+	if err != nil {
+		return t.configError("%v", err)
+	}
+
+	if root != "" {
+		if !filepath.IsAbs(root) {
+			return t.configError("root %q isn't absolute", root)
+		}
+		if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+			return t.configError("root %q isn't a directory", root)
+		}
+	}
+
+	// The binary as the child will see it, after any chroot.
 	finalBin := bin
 	if !filepath.IsAbs(bin) {
-		dirAbs, err := filepath.Abs(dir)
-		if err != nil {
-			return t.configError("finding absolute path of dir %q: %v", dir, err)
+		dirAbs := filepath.Join("/", dir) // within root; "/" if unset
+		if root == "" {
+			dirAbs, err = filepath.Abs(dir)
+			if err != nil {
+				return t.configError("finding absolute path of dir %q: %v", dir, err)
+			}
 		}
 		finalBin = filepath.Clean(filepath.Join(dirAbs, bin))
 	}
+	finalBin = filepath.Join(root, finalBin)
 
 	_, err = os.Stat(finalBin)
 	if err != nil {
@@ -282,11 +624,20 @@ func (t *Task) updateFromConfig(jc jsonconfig.Obj) (err error) {
 	argv = append(argv, args...)
 
 	lr := &LaunchRequest{
-		Path:     bin,
-		Env:      env,
-		Dir:      dir,
-		Argv:     argv,
-		NumFiles: numFiles,
+		Path:    bin,
+		Env:     env,
+		Dir:     dir,
+		Argv:    argv,
+		Root:    root,
+		Rlimits: rlimits,
+		Sandbox: sandbox,
+		Sched:   sched,
+
+		HostPath: finalBin,
+
+		LimitCapabilities: limitCaps,
+		Capabilities:      caps,
+		NoNewPrivileges:   noNewPrivs,
 	}
 
 	if runas != nil {
@@ -310,23 +661,179 @@ func (t *Task) updateFromConfig(jc jsonconfig.Obj) (err error) {
 		lr.Gids = append(lr.Gids, gid)
 	}
 
-	cmd, outPipe, errPipe, err := lr.start(extraFiles)
+	// Close listeners for ports no longer in the config.
+	keep := make(map[string]bool)
+	for _, ps := range portSpecs {
+		for i := 0; i < numReplicas; i++ {
+			addr, err := ps.replicaAddr(i)
+			if err != nil {
+				return t.configError("%v", err)
+			}
+			keep[addr] = true
+		}
+	}
+	t.closeListeners(keep)
+
+	t.configErr = nil
+	t.restart = restart
+	t.log.setConfig(logConfig)
+	if numReplicas < len(t.replicas) {
+		t.stopReplicas(t.replicas[numReplicas:])
+	}
+	t.setReplicas(numReplicas)
+
+	rs := t.replicas
+	if only != nil {
+		rs = []*replica{only}
+	}
+	for _, r := range rs {
+		asNext := false
+		if r.running != nil {
+			if !overlap {
+				continue
+			}
+			if r.next != nil {
+				// Superseded before it became ready.
+				t.stopInstances([]*TaskInstance{r.next})
+				r.next = nil
+			}
+			asNext = true
+		}
+		in := &TaskInstance{
+			task:      t,
+			replica:   r,
+			config:    jc,
+			StartTime: time.Now(),
+
+			stopSignal:    stopSignal,
+			stopTimeout:   stopTimeout,
+			restart:       restart,
+			oneshot:       oneshot,
+			successCodes:  successCodes,
+			healthCheck:   healthCheck,
+			rollout:       rollout,
+			readyNotify:   readyNotify,
+			watchdog:      watchdog,
+			logFormat:     logFormat,
+			maxLineLength: maxLineLength,
+			cgroupConf:    cgroupConf,
+			output:        TaskOutput{log: t.log, hub: t.hub},
+			portAddrs:     make(map[string]string),
+			done:          make(chan struct{}),
+		}
+		t.startInstance(in, lr, portSpecs, asNext)
+	}
+	return nil
+}
+
+// startInstance launches in, a new instance of replica in.replica,
+// from lr and the task's ports. If asNext is set, in becomes the
+// replica's next instance, taking over from its running instance
+// once ready.
+// run in Task.loop
+func (t *Task) startInstance(in *TaskInstance, lr *LaunchRequest, portSpecs []*portSpec, asNext bool) error {
+	r := in.replica
+	if asNext {
+		r.Printf("rolling out new instance alongside PID %d", r.running.Pid())
+	} else {
+		r.setState(StateStarting, "launching")
+	}
+
+	lrCopy := *lr
+	lr = &lrCopy
+	lr.Env = append(lr.Env[:len(lr.Env):len(lr.Env)], fmt.Sprintf("RUNSIT_REPLICA_INDEX=%d", r.index))
+
+	extraFiles := []*os.File{}
+	for _, ps := range portSpecs {
+		addr, _ := ps.replicaAddr(r.index) // validated by startReplicas
+		ln, ok := t.listeners[addr]
+		if !ok {
+			var err error
+			ln, err = listen(addr)
+			if err != nil && asNext {
+				return t.nextStartFailed(in, "port %q listen error: %v", ps.name, err)
+			}
+			if err != nil {
+				restartIn := 5 * time.Second
+				r.retryIn(restartIn)
+				return r.startError("port %q listen error: %v; restarting in %v", ps.name, err, restartIn)
+			}
+			Logger.Printf("opened port named %q on %v; fd=%d", ps.name, addr, ln.f.Fd())
+			t.listeners[addr] = ln
+		}
+		in.portAddrs[ps.name] = ln.addr
+		lr.Env = append(lr.Env, fmt.Sprintf("RUNSIT_PORTFD_%s=%d", ps.name, 3+len(extraFiles)))
+		extraFiles = append(extraFiles, ln.f)
+	}
+
+	notifyConn, notifyChild, err := notifyPipe()
+	if err != nil && asNext {
+		return t.nextStartFailed(in, "notify socket error: %v", err)
+	}
 	if err != nil {
-		return t.startError("failed to start: %v", err)
+		return r.startError("notify socket error: %v", err)
 	}
+	lr.Env = append(lr.Env, fmt.Sprintf("RUNSIT_NOTIFY_FD=%d", 3+len(extraFiles)))
+	if in.watchdog > 0 {
+		lr.Env = append(lr.Env, fmt.Sprintf("RUNSIT_WATCHDOG_USEC=%d", in.watchdog/time.Microsecond))
+	}
+	extraFiles = append(extraFiles, notifyChild)
 
-	instance := &TaskInstance{
-		task:      t,
-		config:    jc,
-		StartTime: time.Now(),
-		Lr:        lr,
-		cmd:       cmd,
+	if in.cgroupConf != nil {
+		dir, err := newCgroup(t.Name, r.index, in.cgroupConf)
+		if err != nil {
+			notifyConn.Close()
+			notifyChild.Close()
+		}
+		if err != nil && asNext {
+			return t.nextStartFailed(in, "cgroup error: %v", err)
+		}
+		if err != nil {
+			return r.startError("cgroup error: %v", err)
+		}
+		in.cgroup = dir
+		lr.Cgroup = dir
 	}
+	in.Lr = lr
 
-	t.Printf("started with PID %d", instance.Pid())
-	t.running = instance
-	go instance.watchPipe(outPipe, "stdout")
-	go instance.watchPipe(errPipe, "stderr")
-	go instance.awaitDeath()
+	cmd, outPipe, errPipe, err := lr.start(extraFiles)
+	notifyChild.Close()
+	if err != nil {
+		notifyConn.Close()
+		if in.cgroup != "" {
+			removeCgroup(in.cgroup)
+		}
+	}
+	if err != nil && asNext {
+		return t.nextStartFailed(in, "failed to start: %v", err)
+	}
+	if err != nil {
+		return r.startError("failed to start: %v", err)
+	}
+	in.cmd = cmd
+
+	go in.watchPipe(outPipe, "stdout")
+	go in.watchPipe(errPipe, "stderr")
+	go in.awaitDeath()
+	go in.trackDescendants()
+	go in.sampleProc()
+	go in.watchNotify(notifyConn)
+	t.armWatchdog(in)
+	if in.healthCheck != nil {
+		go in.watchHealth()
+	}
+	if asNext {
+		r.next = in
+		t.awaitReady(in)
+		r.setState(StateRunning, "started PID %d; stopping PID %d once it's ready", in.Pid(), r.running.Pid())
+		return nil
+	}
+	r.startErr = nil
+	r.running = in
+	if in.readyNotify {
+		r.setState(StateStarting, "started with PID %d; waiting for READY=1", in.Pid())
+		return nil
+	}
+	r.setState(StateRunning, "started with PID %d", in.Pid())
 	return nil
 }
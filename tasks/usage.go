@@ -0,0 +1,120 @@
+package tasks
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// procSampleInterval is how often a running instance's process is
+// sampled; see sampleProc.
+const procSampleInterval = 5 * time.Second
+
+// ExitInfo is how an instance's process exited, and the resources it
+// used, from its ProcessState.
+type ExitInfo struct {
+	Code       int            // exit code, or -1 if killed by a signal
+	Signal     syscall.Signal // signal that killed it, or 0
+	CoreDumped bool
+	UserTime   time.Duration
+	SystemTime time.Duration
+	MaxRSS     int64         // bytes; the largest resident set size
+	Duration   time.Duration // how long it ran
+}
+
+// newExitInfo returns the ExitInfo of ps, a process that ran for
+// duration d.
+func newExitInfo(ps *os.ProcessState, d time.Duration) *ExitInfo {
+	e := &ExitInfo{
+		Code:       ps.ExitCode(),
+		UserTime:   ps.UserTime(),
+		SystemTime: ps.SystemTime(),
+		Duration:   d,
+	}
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		e.Signal = ws.Signal()
+		e.CoreDumped = ws.CoreDump()
+	}
+	if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+		e.MaxRSS = int64(ru.Maxrss)
+		if runtime.GOOS != "darwin" {
+			e.MaxRSS *= 1024 // kilobytes, except on darwin
+		}
+	}
+	return e
+}
+
+func (e *ExitInfo) String() string {
+	var str string
+	switch {
+	case e.Signal != 0 && e.CoreDumped:
+		str = fmt.Sprintf("killed by %s (core dumped)", signalName(e.Signal))
+	case e.Signal != 0:
+		str = fmt.Sprintf("killed by %s", signalName(e.Signal))
+	default:
+		str = fmt.Sprintf("exited with status %d", e.Code)
+	}
+	return fmt.Sprintf("%s after %v; CPU %v user, %v system; max RSS %s", str, roundDuration(e.Duration),
+		e.UserTime.Truncate(time.Millisecond), e.SystemTime.Truncate(time.Millisecond), byteSize(e.MaxRSS))
+}
+
+// ProcSample is a sample of a running instance's process, from /proc.
+type ProcSample struct {
+	Time       time.Time
+	State      string // such as "S (sleeping)"
+	Threads    int
+	RSS        int64         // bytes
+	PeakRSS    int64         // bytes
+	VirtSize   int64         // bytes
+	CPUTime    time.Duration // user and system
+	CPUPercent float64       // of one CPU, since the previous sample
+}
+
+func (s *ProcSample) String() string {
+	parts := []string{
+		s.State,
+		fmt.Sprintf("%d threads", s.Threads),
+		fmt.Sprintf("RSS %s (peak %s)", byteSize(s.RSS), byteSize(s.PeakRSS)),
+		fmt.Sprintf("virtual %s", byteSize(s.VirtSize)),
+		fmt.Sprintf("CPU %v (%.1f%%)", s.CPUTime.Truncate(10*time.Millisecond), s.CPUPercent),
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Sample returns the latest sample of the instance's process, or nil
+// if there isn't one.
+func (in *TaskInstance) Sample() *ProcSample {
+	in.sampleMu.Lock()
+	defer in.sampleMu.Unlock()
+	return in.sample
+}
+
+// sampleProc periodically samples the instance's process until it
+// exits.
+// run in its own goroutine
+func (in *TaskInstance) sampleProc() {
+	var prev *ProcSample
+	for {
+		s, err := readProcSample(in.Pid())
+		if err != nil {
+			return
+		}
+		if prev != nil {
+			if wall := s.Time.Sub(prev.Time); wall > 0 {
+				s.CPUPercent = 100 * float64(s.CPUTime-prev.CPUTime) / float64(wall)
+			}
+		}
+		in.sampleMu.Lock()
+		in.sample = s
+		in.sampleMu.Unlock()
+		prev = s
+		select {
+		case <-time.After(procSampleInterval):
+		case <-in.done:
+			return
+		}
+	}
+}
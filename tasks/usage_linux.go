@@ -0,0 +1,61 @@
+package tasks
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTick is the unit of CPU times in /proc/pid/stat: USER_HZ,
+// which is 100 on every architecture Linux supports.
+const clockTick = time.Second / 100
+
+// readProcSample samples process pid from /proc/pid/stat and status.
+func readProcSample(pid int) (*ProcSample, error) {
+	s := &ProcSample{Time: time.Now()}
+	p, err := readProc(pid)
+	if err != nil {
+		return nil, err
+	}
+	if p.state == 'Z' {
+		return nil, errors.New("process exited")
+	}
+	s.CPUTime = time.Duration(p.utime+p.stime) * clockTick
+
+	f, err := os.Open("/proc/" + strconv.Itoa(pid) + "/status")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		kv := strings.SplitN(sc.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := strings.TrimSpace(kv[1])
+		switch kv[0] {
+		case "State":
+			s.State = v
+		case "Threads":
+			s.Threads, _ = strconv.Atoi(v)
+		case "VmRSS":
+			s.RSS = statusKB(v)
+		case "VmHWM":
+			s.PeakRSS = statusKB(v)
+		case "VmSize":
+			s.VirtSize = statusKB(v)
+		}
+	}
+	return s, sc.Err()
+}
+
+// statusKB parses a /proc/pid/status size, such as "1234 kB", into
+// bytes.
+func statusKB(v string) int64 {
+	n, _ := strconv.ParseInt(strings.TrimSuffix(v, " kB"), 10, 64)
+	return n * 1024
+}
@@ -0,0 +1,9 @@
+// +build !linux
+
+package tasks
+
+import "errors"
+
+func readProcSample(pid int) (*ProcSample, error) {
+	return nil, errors.New("process sampling not supported on this OS")
+}
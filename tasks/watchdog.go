@@ -0,0 +1,53 @@
+package tasks
+
+import (
+	"fmt"
+	"time"
+)
+
+// armWatchdog (re)starts the instance's watchdog timer, if it has a
+// watchdogInterval. If the timer fires before the next WATCHDOG=1
+// notify message re-arms it, the instance is considered hung.
+// run in Task.loop
+func (t *Task) armWatchdog(in *TaskInstance) {
+	if in.watchdog <= 0 {
+		return
+	}
+	if in.watchdogTimer != nil {
+		in.watchdogTimer.Stop()
+	}
+	in.watchdogGen++
+	gen := in.watchdogGen
+	in.watchdogTimer = time.AfterFunc(in.watchdog, func() {
+		t.controlc <- watchdogMessage{in, gen}
+	})
+}
+
+// stopWatchdog stops the instance's watchdog timer, if any.
+// run in Task.loop
+func (in *TaskInstance) stopWatchdog() {
+	if in.watchdogTimer != nil {
+		in.watchdogTimer.Stop()
+		in.watchdogTimer = nil
+	}
+	in.watchdogGen++
+}
+
+// run in Task.loop
+func (t *Task) onWatchdog(m watchdogMessage) {
+	in := m.in
+	r := in.replica
+	if m.gen != in.watchdogGen || (in != r.running && in != r.next) {
+		return
+	}
+	in.stopWatchdog()
+	in.failReason = fmt.Sprintf("missed keepalive: none in %v", in.watchdog)
+	in.Printf("%s; restarting", in.failReason)
+	if in == r.next {
+		t.stopInstances([]*TaskInstance{in})
+		t.onNextFailed(in, in.failReason)
+		return
+	}
+	t.stopReplicas([]*replica{r})
+	t.afterExit(in, true)
+}
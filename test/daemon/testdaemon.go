@@ -27,7 +27,10 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/bradfitz/runsit/notify"
 )
 
 var (
@@ -70,6 +73,31 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+var (
+	hang     = make(chan bool)
+	hangOnce sync.Once
+)
+
+func hangHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "no more keepalives\n")
+	hangOnce.Do(func() { close(hang) })
+}
+
+func keepalive() {
+	d := notify.WatchdogInterval() / 2
+	if d == 0 {
+		return
+	}
+	for {
+		select {
+		case <-time.After(d):
+			notify.Watchdog()
+		case <-hang:
+			return
+		}
+	}
+}
+
 func logNoise() {
 	for {
 		log.Printf("some log noise")
@@ -94,11 +122,16 @@ func main() {
 		log.Fatalf("error listening on port %d: %v", *port, err)
 	}
 
+	notify.Status(fmt.Sprintf("listening on port %d", *port))
+	notify.Ready()
+
 	fmt.Fprintf(os.Stdout, "Hello on stdout; listening on port %d\n", *port)
 	fmt.Fprintf(os.Stderr, "Hello on stderr\n")
 	go logNoise()
+	go keepalive()
 
 	http.HandleFunc("/crash", crashHandler)
+	http.HandleFunc("/hang", hangHandler)
 	http.HandleFunc("/", statusHandler)
 
 	s := &http.Server{}